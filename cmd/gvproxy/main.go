@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
@@ -18,6 +17,7 @@ import (
 	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/net/stdio"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
 	"github.com/containers/gvisor-tap-vsock/pkg/sshclient"
 	"github.com/containers/gvisor-tap-vsock/pkg/transport"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
@@ -46,6 +46,15 @@ var (
 	pidFile         string
 	exitCode        int
 	logFile         string
+	dnsUpstream     string
+	dnsHostsFiles   arrayFlags
+	dnsTTL          uint
+	dnsBlocklists   arrayFlags
+	dnsAllowlists   arrayFlags
+	dnsBlockNull    bool
+	dnsRateLimit    float64
+	dnsRateBurst    int
+	mdnsResponder   bool
 )
 
 const (
@@ -74,6 +83,15 @@ func main() {
 	flag.Var(&forwardIdentify, "forward-identity", "Path to SSH identity key for forwarding")
 	flag.StringVar(&pidFile, "pid-file", "", "Generate a file with the PID in it")
 	flag.StringVar(&logFile, "log-file", "", "Output log messages (logrus) to a given file path")
+	flag.StringVar(&dnsUpstream, "dns-upstream", "", "Upstream nameserver of the embedded DNS server, such as tls://1.1.1.1#cloudflare-dns.com for DNS over TLS or https://cloudflare-dns.com/dns-query for DNS over HTTPS")
+	flag.UintVar(&dnsTTL, "dns-ttl", 0, "TTL of the local answers of the embedded DNS server, such as gateway and host, so that the VMs can cache them")
+	flag.Var(&dnsHostsFiles, "dns-hosts-file", "Hosts file, or directory of hosts files, whose names are resolved by the embedded DNS server, such as /etc/hosts, reloaded when it changes. The names of a file override the ones of the files before it")
+	flag.Var(&dnsBlocklists, "dns-blocklist", "File of names blocked by the embedded DNS server with their subdomains, in the hosts format or one name per line")
+	flag.Var(&dnsAllowlists, "dns-allowlist", "File of names not blocked by -dns-blocklist with their subdomains, in the same formats")
+	flag.BoolVar(&dnsBlockNull, "dns-block-null-address", false, "Answer the names of -dns-blocklist with 0.0.0.0 and :: rather than as nonexistent")
+	flag.Float64Var(&dnsRateLimit, "dns-rate-limit", 0, "Queries per second answered to each client of the embedded DNS server, 0 for no limit")
+	flag.IntVar(&dnsRateBurst, "dns-rate-limit-burst", 0, "Queries answered at once to a client of the embedded DNS server before -dns-rate-limit applies, 0 for a second of queries")
+	flag.BoolVar(&mdnsResponder, "mdns", false, "Answer the mDNS queries of the VMs for gateway.local and host.local")
 	flag.Parse()
 
 	if version.ShowVersion() {
@@ -249,7 +267,16 @@ func main() {
 				},
 			},
 		},
-		DNSSearchDomains: searchDomains(),
+		DNSSearchDomains:    searchDomains(),
+		DNSUpstream:         dnsUpstream,
+		DNSDefaultTTL:       uint32(dnsTTL),
+		DNSHostsFiles:       dnsHostsFiles,
+		DNSBlocklists:       dnsBlocklists,
+		DNSAllowlists:       dnsAllowlists,
+		DNSBlockNullAddress: dnsBlockNull,
+		DNSRateLimit:        dnsRateLimit,
+		DNSRateLimitBurst:   dnsRateBurst,
+		MDNS:                mdnsResponder,
 		Forwards: map[string]string{
 			fmt.Sprintf("127.0.0.1:%d", sshPort): sshHostPort,
 		},
@@ -543,26 +570,18 @@ func exitWithError(err error) {
 }
 
 func searchDomains() []string {
-	if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
-		f, err := os.Open("/etc/resolv.conf")
-		if err != nil {
-			log.Errorf("open file error: %v", err)
-			return nil
-		}
-		defer f.Close()
-		sc := bufio.NewScanner(f)
-		searchPrefix := "search "
-		for sc.Scan() {
-			if strings.HasPrefix(sc.Text(), searchPrefix) {
-				searchDomains := strings.Split(strings.TrimPrefix(sc.Text(), searchPrefix), " ")
-				log.Debugf("Using search domains: %v", searchDomains)
-				return searchDomains
-			}
-		}
-		if err := sc.Err(); err != nil {
-			log.Errorf("scan file error: %v", err)
-			return nil
+	conf, err := dns.GetSystemConfig()
+	if err != nil {
+		log.Errorf("cannot read the DNS configuration of the host: %v", err)
+		return nil
+	}
+	var domains []string
+	for _, domain := range conf.Search {
+		// the DHCP search list takes the domains without the root label
+		if domain = strings.TrimSuffix(domain, "."); domain != "" {
+			domains = append(domains, domain)
 		}
 	}
-	return nil
+	log.Debugf("Using search domains: %v", domains)
+	return domains
 }
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// addAdditionalAnswers adds the addresses of the targets of the SRV and MX
+// answers of m to its additional section, when they are in the local zones,
+// saving the clients a query.
+func (h *dnsHandler) addAdditionalAnswers(m *dns.Msg, client net.IP) {
+	seen := map[string]bool{}
+	for _, rr := range m.Answer {
+		target := additionalTarget(rr)
+		if target == "" || seen[strings.ToLower(target)] {
+			continue
+		}
+		seen[strings.ToLower(target)] = true
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			extra := new(dns.Msg)
+			if !h.addLocalAnswers(extra, dns.Question{Name: target, Qtype: qtype, Qclass: dns.ClassINET}, client) {
+				break
+			}
+			for _, rr := range extra.Answer {
+				if rr.Header().Rrtype == qtype {
+					m.Extra = append(m.Extra, rr)
+				}
+			}
+		}
+	}
+}
+
+// additionalTarget returns the name whose addresses are useful along with rr,
+// or an empty string.
+func additionalTarget(rr dns.RR) string {
+	var target string
+	switch rr := rr.(type) {
+	case *dns.SRV:
+		target = rr.Target
+	case *dns.MX:
+		target = rr.Mx
+	}
+	// "." stands for no service
+	if target == "." {
+		return ""
+	}
+	return target
+}
+
+// fitAdditional leaves the addresses added by addAdditionalAnswers out of m
+// until it fits in size. They are optional, and unlike the other records
+// they don't need the client to retry over TCP.
+func fitAdditional(m *dns.Msg, size int) {
+	targets := map[string]bool{}
+	for _, rr := range m.Answer {
+		if target := additionalTarget(rr); target != "" {
+			targets[strings.ToLower(target)] = true
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	// measure m the way Truncate will pack it
+	compress := m.Compress
+	m.Compress = true
+	defer func() {
+		m.Compress = compress
+	}()
+	for m.Len() > size {
+		last := -1
+		for i, rr := range m.Extra {
+			rrtype := rr.Header().Rrtype
+			if (rrtype == dns.TypeA || rrtype == dns.TypeAAAA) && targets[strings.ToLower(rr.Header().Name)] {
+				last = i
+			}
+		}
+		if last < 0 {
+			return
+		}
+		m.Extra = append(m.Extra[:last], m.Extra[last+1:]...)
+	}
+}
@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns additional section", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		records := []types.Record{
+			{Name: "_http._tcp", SRV: []types.SRVRecord{{Priority: 10, Weight: 10, Port: 8080, Target: "web.internal."}}},
+			{Name: "web", IP: net.ParseIP("192.168.127.2")},
+			{Name: "mail", MX: []types.MXRecord{{Preference: 10, Exchange: "mx.example.com."}}},
+			{Name: "_many._tcp"},
+		}
+		for i := 0; i < 10; i++ {
+			records[3].SRV = append(records[3].SRV, types.SRVRecord{Priority: 10, Weight: 10, Port: 8080, Target: fmt.Sprintf("backend-%02d.internal.", i)})
+			records = append(records, types.Record{Name: fmt.Sprintf("backend-%02d", i), IP: net.ParseIP(fmt.Sprintf("192.168.127.%d", 10+i))})
+		}
+		server = newTestServer([]types.Zone{{Name: "internal.", Records: records}}, WithoutForwarding())
+	})
+
+	ginkgo.It("should add the local addresses of the SRV targets", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("_http._tcp.internal.", dns.TypeSRV))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Extra).To(gomega.HaveLen(1))
+		a := m.Extra[0].(*dns.A)
+		gomega.Expect(a.Hdr.Name).To(gomega.Equal("web.internal."))
+		gomega.Expect(a.A.String()).To(gomega.Equal("192.168.127.2"))
+	})
+
+	ginkgo.It("should not add the targets outside of the local zones", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("mail.internal.", dns.TypeMX))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Extra).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should leave out the additional addresses not fitting over UDP without truncating", func() {
+		w := &fakeResponseWriter{}
+		server.handler.handleUDP(w, query("_many._tcp.internal.", dns.TypeSRV))
+
+		gomega.Expect(w.msg.Truncated).To(gomega.BeFalse())
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(10))
+		gomega.Expect(len(w.msg.Extra)).To(gomega.BeNumerically("<", 10))
+		gomega.Expect(w.msg.Len()).To(gomega.BeNumerically("<=", dns.MinMsgSize))
+
+		w = &fakeResponseWriter{}
+		server.handler.handleTCP(w, query("_many._tcp.internal.", dns.TypeSRV))
+
+		gomega.Expect(w.msg.Extra).To(gomega.HaveLen(10))
+	})
+})
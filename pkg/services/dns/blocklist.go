@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockMode is how the names of a blocklist are answered.
+type BlockMode int
+
+const (
+	// BlockNXDomain answers the blocked names as nonexistent.
+	BlockNXDomain BlockMode = iota
+	// BlockNullAddress answers the A and AAAA queries of the blocked names
+	// with 0.0.0.0 and ::, and their other queries with no record.
+	BlockNullAddress
+)
+
+// hostsFileBuiltins are the names of the hosts files which are not meant to
+// be blocked, the blocklists in the hosts format usually start with them.
+var hostsFileBuiltins = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// Blocklist filters the names answered by the server. A name is blocked
+// when it or one of its parent domains is listed by a blocklist, unless it
+// or one of its parent domains is listed by an allowlist.
+type Blocklist struct {
+	blocklists []string
+	allowlists []string
+	mode       BlockMode
+
+	lock    sync.RWMutex
+	blocked map[string]bool
+	allowed map[string]bool
+}
+
+// NewBlocklist reads the lists at the paths of blocklists and allowlists.
+// Their lines are either a name, or an address followed by names as in a
+// hosts file, the address being ignored. The text after a # is a comment.
+func NewBlocklist(blocklists, allowlists []string, mode BlockMode) (*Blocklist, error) {
+	b := &Blocklist{
+		blocklists: blocklists,
+		allowlists: allowlists,
+		mode:       mode,
+	}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the lists again. A list failing to load keeps the current
+// names.
+func (b *Blocklist) Reload() error {
+	blocked, err := parseDomainLists(b.blocklists)
+	if err != nil {
+		return err
+	}
+	allowed, err := parseDomainLists(b.allowlists)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.blocked = blocked
+	b.allowed = allowed
+	return nil
+}
+
+// Len returns the number of names listed by the blocklists and by the
+// allowlists.
+func (b *Blocklist) Len() (blocked int, allowed int) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.blocked), len(b.allowed)
+}
+
+// Blocked returns true if name is blocked.
+func (b *Blocklist) Blocked(name string) bool {
+	name = strings.ToLower(asciiName(dns.Fqdn(name)))
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return listed(b.blocked, name) && !listed(b.allowed, name)
+}
+
+// listed returns true if name or one of its parent domains is in names.
+func listed(names map[string]bool, name string) bool {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if names[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDomainLists(paths []string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, path := range paths {
+		if err := parseDomainList(path, names); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// parseDomainList adds the names of the list at path to names.
+func parseDomainList(path string, names map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// a line of a hosts file
+		if len(fields) > 1 || net.ParseIP(fields[0]) != nil {
+			if net.ParseIP(fields[0]) == nil {
+				log.Warnf("skipping line %d of domain list %s: invalid address %q", lineNumber, path, fields[0])
+				continue
+			}
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = strings.ToLower(asciiName(dns.Fqdn(strings.TrimPrefix(name, "*."))))
+			if _, ok := dns.IsDomainName(name); !ok || name == "." {
+				log.Warnf("skipping line %d of domain list %s: invalid name %q", lineNumber, path, name)
+				continue
+			}
+			if hostsFileBuiltins[name] {
+				continue
+			}
+			names[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read domain list %s: %w", path, err)
+	}
+	return nil
+}
+
+// addBlockedAnswers answers the queries r for a blocked name according to
+// the mode of the blocklist. It returns false if no name of r is blocked.
+func (h *dnsHandler) addBlockedAnswers(m *dns.Msg, r *dns.Msg) bool {
+	if h.blocklist == nil {
+		return false
+	}
+	blocked := false
+	for _, q := range r.Question {
+		if h.blocklist.Blocked(q.Name) {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return false
+	}
+	addExtendedError(m, r, dns.ExtendedErrorCodeBlocked, "blocklisted name")
+	if h.blocklist.mode == BlockNXDomain {
+		m.Rcode = dns.RcodeNameError
+		return true
+	}
+	for _, q := range r.Question {
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    h.defaultTTL,
+		}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	}
+	return true
+}
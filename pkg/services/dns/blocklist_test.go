@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns blocklist", func() {
+	var (
+		dir       string
+		upstream  *fakeUpstream
+		blocklist string
+		allowlist string
+	)
+
+	writeDomainList := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(os.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "dns-blocklist")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		blocklist = writeDomainList("blocklist", `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com
+0.0.0.0 crc.internal
+# domain list format
+analytics.test
+*.metrics.test
+not_an_address blocked.test
+`)
+		allowlist = writeDomainList("allowlist", "ok.analytics.test\n")
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+		os.RemoveAll(dir)
+	})
+
+	newServer := func(mode BlockMode) *Server {
+		list, err := NewBlocklist([]string{blocklist}, []string{allowlist}, mode)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		server := newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.3")}},
+		}}, WithBlocklist(list), WithUpstream(upstream.addr()))
+		return server
+	}
+
+	ginkgo.It("should parse the hosts and the domain list formats", func() {
+		list, err := NewBlocklist([]string{blocklist}, nil, BlockNXDomain)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		gomega.Expect(list.blocked).To(gomega.Equal(map[string]bool{
+			"ads.example.com.":     true,
+			"tracker.example.com.": true,
+			"crc.internal.":        true,
+			"analytics.test.":      true,
+			"metrics.test.":        true,
+		}))
+	})
+
+	ginkgo.It("should answer the blocked names and their subdomains as nonexistent", func() {
+		server := newServer(BlockNXDomain)
+
+		for _, name := range []string{"ads.example.com.", "ADS.example.com.", "www.analytics.test.", "a.metrics.test."} {
+			w := &fakeResponseWriter{}
+			server.handler.handleUDP(w, edns0Query(name, dns.TypeA))
+			gomega.Expect(w.msg.Rcode).To(gomega.Equal(dns.RcodeNameError), name)
+			gomega.Expect(extendedError(w.msg).InfoCode).To(gomega.Equal(dns.ExtendedErrorCodeBlocked))
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should answer the blocked names with the null addresses", func() {
+		server := newServer(BlockNullAddress)
+
+		w := &fakeResponseWriter{}
+		server.handler.handleUDP(w, query("ads.example.com.", dns.TypeA))
+		gomega.Expect(w.msg.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(w.msg.Answer[0].(*dns.A).A.Equal(net.IPv4zero)).To(gomega.BeTrue())
+
+		server.handler.handleUDP(w, query("ads.example.com.", dns.TypeAAAA))
+		gomega.Expect(w.msg.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero)).To(gomega.BeTrue())
+
+		server.handler.handleUDP(w, query("ads.example.com.", dns.TypeTXT))
+		gomega.Expect(w.msg.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(w.msg.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should forward the allowed and the other names", func() {
+		server := newServer(BlockNXDomain)
+
+		for _, name := range []string{"ok.analytics.test.", "www.ok.analytics.test.", "www.example.com.", "localhost."} {
+			w := &fakeResponseWriter{}
+			server.handler.handleUDP(w, query(name, dns.TypeA))
+			gomega.Expect(w.msg.Rcode).To(gomega.Equal(dns.RcodeSuccess), name)
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(4))
+	})
+
+	ginkgo.It("should answer the records of the local zones even if blocked", func() {
+		server := newServer(BlockNXDomain)
+
+		w := &fakeResponseWriter{}
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(w.msg.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.3"))
+	})
+
+	ginkgo.It("should reload the lists through the mux", func() {
+		server := newServer(BlockNXDomain)
+		gomega.Expect(os.WriteFile(blocklist, []byte("ads.example.com\nnew.test\nmore.test\n"), 0600)).To(gomega.Succeed())
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/blocklist", nil))
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"blocked": 3, "allowed": 1}`))
+		gomega.Expect(server.handler.blocklist.Blocked("new.test.")).To(gomega.BeTrue())
+		gomega.Expect(server.handler.blocklist.Blocked("analytics.test.")).To(gomega.BeFalse())
+
+		// a list failing to load keeps the current names
+		gomega.Expect(os.Remove(blocklist)).To(gomega.Succeed())
+		rec = httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/blocklist", nil))
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusInternalServerError))
+		gomega.Expect(server.handler.blocklist.Blocked("new.test.")).To(gomega.BeTrue())
+
+		rec = httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blocklist", nil))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"blocked": 3, "allowed": 1}`))
+	})
+
+	ginkgo.It("should answer 404 on the mux without a blocklist", func() {
+		server := newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/blocklist", nil))
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusNotFound))
+	})
+})
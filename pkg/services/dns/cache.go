@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// staleTTL is the TTL given to answers served past their expiry (RFC 8767 recommends 30 seconds).
+	staleTTL = 30
+	// defaultCacheSize is the number of answers cached unless configured otherwise with WithCacheSize.
+	defaultCacheSize = 10000
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// the answers with the DNSSEC records and the unvalidated answers are
+	// kept apart from the others
+	dnssecOK         bool
+	checkingDisabled bool
+}
+
+// queryCacheKey returns the key of the answer to r.
+func queryCacheKey(r *dns.Msg) cacheKey {
+	key := newCacheKey(r.Question[0])
+	if opt := r.IsEdns0(); opt != nil {
+		key.dnssecOK = opt.Do()
+	}
+	key.checkingDisabled = r.CheckingDisabled
+	return key
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+}
+
+type cacheEntry struct {
+	msg        *dns.Msg
+	stored     time.Time
+	ttl        time.Duration
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheHit
+	cacheStale
+)
+
+// cache stores upstream responses until the smallest TTL of their records expires.
+type cache struct {
+	lock    sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	// entries past their expiry can still be served during maxStale
+	maxStale time.Duration
+	// entries hit at least prefetchHits times are refreshed shortly before they expire
+	prefetchHits int
+	// a new entry evicts another one once there are maxEntries
+	maxEntries int
+	now        func() time.Time
+}
+
+func newCache() *cache {
+	return &cache{
+		entries:    make(map[cacheKey]*cacheEntry),
+		maxEntries: defaultCacheSize,
+		now:        time.Now,
+	}
+}
+
+// get returns a copy of the cached response for key. refresh is true if the
+// entry is stale or about to expire, and the caller is the one responsible
+// for refreshing it.
+func (c *cache) get(key cacheKey) (msg *dns.Msg, state cacheState, refresh bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, cacheMiss, false
+	}
+	now := c.now()
+	if now.Before(entry.expires) {
+		entry.hits++
+		msg := entry.msg.Copy()
+		decrementTTL(msg, uint32(now.Sub(entry.stored)/time.Second))
+		if c.shouldPrefetch(entry, now) {
+			entry.refreshing = true
+			return msg, cacheHit, true
+		}
+		return msg, cacheHit, false
+	}
+	if now.Before(entry.expires.Add(c.maxStale)) {
+		msg := entry.msg.Copy()
+		setTTL(msg, staleTTL)
+		refresh = !entry.refreshing
+		entry.refreshing = true
+		return msg, cacheStale, refresh
+	}
+	delete(c.entries, key)
+	return nil, cacheMiss, false
+}
+
+// shouldPrefetch returns true for popular entries in the last tenth of their TTL.
+func (c *cache) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if c.prefetchHits <= 0 || entry.hits < c.prefetchHits || entry.refreshing {
+		return false
+	}
+	return entry.expires.Sub(now) < entry.ttl/10
+}
+
+func (c *cache) set(key cacheKey, msg *dns.Msg) {
+	ttl, ok := cacheableTTL(msg)
+	if !ok || c.maxEntries <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{
+		msg:     msg.Copy(),
+		stored:  now,
+		ttl:     time.Duration(ttl) * time.Second,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// evict removes the entries which can no longer be served, or else the
+// one expiring first. It must be called with the lock held.
+func (c *cache) evict(now time.Time) {
+	var first cacheKey
+	var firstExpires time.Time
+	evicted := false
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires.Add(c.maxStale)) {
+			delete(c.entries, key)
+			evicted = true
+			continue
+		}
+		if firstExpires.IsZero() || entry.expires.Before(firstExpires) {
+			first, firstExpires = key, entry.expires
+		}
+	}
+	if !evicted && !firstExpires.IsZero() {
+		delete(c.entries, first)
+	}
+}
+
+// refreshFailed allows another hit to retry the refresh of key.
+func (c *cache) refreshFailed(key cacheKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.refreshing = false
+	}
+}
+
+// cacheableTTL returns the smallest TTL of the records in msg, and false if msg must not be cached.
+// The negative answers are cached for the minimum TTL of the SOA of their zone, when lower (RFC 2308).
+func cacheableTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	found := false
+	var ttl uint32
+	for _, rr := range records(msg) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+		if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	return ttl, found && ttl > 0
+}
+
+func setTTL(msg *dns.Msg, ttl uint32) {
+	for _, rr := range records(msg) {
+		rr.Header().Ttl = ttl
+	}
+}
+
+// decrementTTL removes the time elapsed since msg was cached from the TTL of its records.
+func decrementTTL(msg *dns.Msg, elapsed uint32) {
+	for _, rr := range records(msg) {
+		if rr.Header().Ttl > elapsed {
+			rr.Header().Ttl -= elapsed
+		} else {
+			rr.Header().Ttl = 0
+		}
+	}
+}
+
+// records returns the resource records of msg, ignoring the OPT pseudo-record.
+func records(msg *dns.Msg) []dns.RR {
+	var rrs []dns.RR
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// flush removes the entries for domain and the names under it, or all the
+// entries if domain is empty. It returns the number of entries removed.
+func (c *cache) flush(domain string) int {
+	domain = strings.ToLower(domain)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	flushed := 0
+	for key := range c.entries {
+		if domain == "" || dns.IsSubDomain(domain, key.name) {
+			delete(c.entries, key)
+			flushed++
+		}
+	}
+	return flushed
+}
@@ -0,0 +1,43 @@
+package dns
+
+import "github.com/miekg/dns"
+
+// cacheStatusCode is the EDNS0 option, from the range of local use (RFC 6891),
+// telling whether a forwarded answer was served from the cache.
+const cacheStatusCode = 65001
+
+var cacheStates = map[cacheState]string{
+	cacheMiss:  "miss",
+	cacheHit:   "hit",
+	cacheStale: "stale",
+}
+
+// addCacheStatus tells in m, the response to r, whether it was served from the
+// cache. It is only added if r uses EDNS0.
+func addCacheStatus(m *dns.Msg, r *dns.Msg, state cacheState) {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, reqOpt.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: cacheStatusCode, Data: []byte(cacheStates[state])})
+}
+
+// cacheStatus returns the cache status added to m by addCacheStatus, or an
+// empty string if there is none.
+func cacheStatus(m *dns.Msg) string {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == cacheStatusCode {
+			return string(local.Data)
+		}
+	}
+	return ""
+}
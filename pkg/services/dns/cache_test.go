@@ -0,0 +1,273 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
+
+var _ = ginkgo.Describe("dns cache", func() {
+	var (
+		server   *Server
+		upstream *fakeUpstream
+		clock    *fakeClock
+	)
+
+	ginkgo.BeforeEach(func() {
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		var err error
+		server, err = New(nil, nil, []types.Zone{}, WithStaleServing(time.Hour), WithUpstream(upstream.addr()))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		clock = &fakeClock{t: time.Now()}
+		server.handler.cache.now = clock.now
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+	})
+
+	ginkgo.It("should tell whether the answers were served from the cache", func() {
+		WithCacheStatus()(server)
+
+		statuses := []string{}
+		for i := 0; i < 2; i++ {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+			statuses = append(statuses, cacheStatus(m))
+		}
+		clock.advance(2 * time.Minute)
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+		statuses = append(statuses, cacheStatus(m))
+
+		gomega.Expect(statuses).To(gomega.Equal([]string{"miss", "hit", "stale"}))
+		// the status is not cached along with the answer
+		gomega.Expect(server.handler.cache.entries[newCacheKey(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})].msg.IsEdns0()).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should not tell the cache status unless enabled", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+
+		gomega.Expect(cacheStatus(m)).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should serve fresh answers from the cache", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1"))).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should serve stale answers when the upstream is offline", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		upstream.stop()
+		clock.advance(2 * time.Minute)
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1"))).To(gomega.BeTrue())
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(staleTTL)))
+
+		// the background refresh fails, the stale answer keeps being served
+		gomega.Eventually(func() bool {
+			_, _, refresh := server.handler.cache.get(newCacheKey(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}))
+			return refresh
+		}, 5*time.Second).Should(gomega.BeTrue())
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should stop serving stale answers after the max stale duration", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		upstream.stop()
+		clock.advance(2 * time.Hour)
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should prefetch popular answers before they expire", func() {
+		server = newTestServer([]types.Zone{}, WithPrefetch(3), WithUpstream(upstream.addr()))
+		server.handler.cache.now = clock.now
+
+		for i := 0; i < 3; i++ {
+			server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+
+		clock.advance(55 * time.Second)
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Eventually(upstream.queryCount, 5*time.Second).Should(gomega.Equal(2))
+
+		// the refreshed answer is still fresh after the original TTL
+		clock.advance(10 * time.Second)
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should not prefetch rarely queried answers", func() {
+		server = newTestServer([]types.Zone{}, WithPrefetch(3), WithUpstream(upstream.addr()))
+		server.handler.cache.now = clock.now
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		clock.advance(55 * time.Second)
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Consistently(upstream.queryCount, 200*time.Millisecond).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should decrement the TTL of cached answers", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		clock.advance(25*time.Second + 500*time.Millisecond)
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(35)))
+	})
+
+	ginkgo.It("should query the upstream again once the TTL reached zero", func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()))
+		server.handler.cache.now = clock.now
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		clock.advance(60 * time.Second)
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(60)))
+	})
+
+	ginkgo.It("should query the upstream again after the cache is flushed", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+
+		gomega.Expect(server.FlushCache("")).To(gomega.Equal(1))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should only flush the answers for the names under the domain given", func() {
+		for _, name := range []string{"example.com.", "www.Example.com.", "example.org."} {
+			server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+		}
+
+		gomega.Expect(server.FlushCache("example.com")).To(gomega.Equal(2))
+		for _, name := range []string{"example.com.", "www.example.com.", "example.org."} {
+			server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+		}
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(5))
+	})
+
+	ginkgo.It("should flush the cache on /flush", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.org.", dns.TypeA))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/flush?name=example.org", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"flushed": 1}`))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.org.", dns.TypeA))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(3))
+	})
+
+	ginkgo.It("should reject an invalid name on /flush", func() {
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/flush?name=a..b", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should evict the answer expiring first once full", func() {
+		WithCacheSize(2)(server)
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("a.example.com.", dns.TypeA))
+		clock.advance(time.Second)
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("b.example.com.", dns.TypeA))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("c.example.com.", dns.TypeA))
+
+		gomega.Expect(server.handler.cache.entries).To(gomega.HaveLen(2))
+		gomega.Expect(server.handler.cache.entries).NotTo(gomega.HaveKey(newCacheKey(dns.Question{Name: "a.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})))
+	})
+
+	ginkgo.It("should evict the answers past their max stale duration first", func() {
+		WithCacheSize(2)(server)
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("a.example.com.", dns.TypeA))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("b.example.com.", dns.TypeA))
+		clock.advance(2 * time.Hour)
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("c.example.com.", dns.TypeA))
+
+		gomega.Expect(server.handler.cache.entries).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should not cache anything with a size of 0", func() {
+		WithCacheSize(0)(server)
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should cache the negative answers for the minimum TTL of their SOA", func() {
+		exchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg)
+			resp.SetRcode(m, dns.RcodeNameError)
+			resp.Ns = append(resp.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:     "ns.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Minttl: 30,
+			})
+			return resp, nil
+		}}
+		WithExchanger(exchanger)(server)
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("missing.example.com.", dns.TypeA))
+		clock.advance(20 * time.Second)
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("missing.example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+
+		clock.advance(20 * time.Second)
+		server.handler.cache.maxStale = 0
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("missing.example.com.", dns.TypeA))
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(2))
+	})
+})
@@ -0,0 +1,40 @@
+package dns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// addChaosAnswers answers the TXT queries of the CHAOS class identifying the
+// server: version.bind with the version, hostname.bind and id.server with the
+// hostname. They are refused when not configured, and so are the other
+// queries of this class, which are never forwarded. It returns false if r
+// is not a CHAOS query.
+func (h *dnsHandler) addChaosAnswers(m *dns.Msg, r *dns.Msg) bool {
+	if len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassCHAOS {
+		return false
+	}
+	q := r.Question[0]
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.":
+		value = h.chaosVersion
+	case "hostname.bind.", "id.server.":
+		value = h.chaosHostname
+	}
+	if value == "" || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		m.Rcode = dns.RcodeRefused
+		return true
+	}
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+		},
+		Txt: []string{value},
+	})
+	return true
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"context"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func chaosQuery(name string) *dns.Msg {
+	r := query(name, dns.TypeTXT)
+	r.Question[0].Qclass = dns.ClassCHAOS
+	return r
+}
+
+var _ = ginkgo.Describe("dns CHAOS queries", func() {
+	var exchanger *mockExchanger
+
+	ginkgo.BeforeEach(func() {
+		exchanger = &mockExchanger{respond: answerA("10.0.0.1", 60)}
+	})
+
+	answer := func(server *Server, name string) *dns.Msg {
+		return server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, chaosQuery(name))
+	}
+
+	for name, value := range map[string]string{
+		"version.bind.":  "gvisor-tap-vsock 1.0",
+		"hostname.bind.": "gateway",
+		"id.server.":     "gateway",
+	} {
+		name, value := name, value
+		ginkgo.It("should answer "+name+" with the configured value", func() {
+			server := newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithChaosIdentity("gvisor-tap-vsock 1.0", "gateway"))
+
+			m := answer(server, name)
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			txt := m.Answer[0].(*dns.TXT)
+			gomega.Expect(txt.Hdr.Class).To(gomega.Equal(uint16(dns.ClassCHAOS)))
+			gomega.Expect(txt.Txt).To(gomega.Equal([]string{value}))
+		})
+	}
+
+	ginkgo.It("should refuse the CHAOS queries without forwarding them by default", func() {
+		server := newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+
+		for _, name := range []string{"version.bind.", "hostname.bind.", "id.server.", "authors.bind."} {
+			m := answer(server, name)
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused), name)
+			gomega.Expect(m.Answer).To(gomega.BeEmpty(), name)
+		}
+		gomega.Expect(exchanger.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should refuse the names without a value", func() {
+		server := newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithChaosIdentity("", "gateway"))
+
+		gomega.Expect(answer(server, "version.bind.").Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(answer(server, "id.server.").Rcode).To(gomega.Equal(dns.RcodeSuccess))
+	})
+})
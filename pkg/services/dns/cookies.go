@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const clientCookieLen = 16 // hex-encoded length of the 8 bytes client cookie
+
+var errBadCookie = errors.New("upstream response has an invalid client cookie")
+
+type upstreamCookie struct {
+	client string
+	server string
+}
+
+// cookies adds DNS cookies (RFC 7873) to the queries sent to the upstream
+// nameservers, so that spoofed responses can be detected and dropped.
+type cookies struct {
+	lock      sync.Mutex
+	upstreams map[string]*upstreamCookie
+}
+
+func newCookies() *cookies {
+	return &cookies{upstreams: make(map[string]*upstreamCookie)}
+}
+
+func (c *cookies) get(upstream string) (upstreamCookie, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cookie, ok := c.upstreams[upstream]
+	if !ok {
+		b := make([]byte, clientCookieLen/2)
+		if _, err := rand.Read(b); err != nil {
+			return upstreamCookie{}, err
+		}
+		cookie = &upstreamCookie{client: hex.EncodeToString(b)}
+		c.upstreams[upstream] = cookie
+	}
+	return *cookie, nil
+}
+
+// add returns a copy of r carrying the cookie of upstream, in place of the
+// one the client may have sent to us.
+func (c *cookies) add(r *dns.Msg, upstream string) (*dns.Msg, error) {
+	cookie, err := c.get(upstream)
+	if err != nil {
+		return nil, err
+	}
+	msg := r.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	removeCookie(opt)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie.client + cookie.server,
+	})
+	return msg, nil
+}
+
+// check validates the cookie of the response of upstream and records the server cookie it contains.
+func (c *cookies) check(resp *dns.Msg, upstream string) error {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		// the upstream doesn't support cookies
+		return nil
+	}
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		known, ok := c.upstreams[upstream]
+		if !ok || len(cookie.Cookie) < clientCookieLen || !strings.EqualFold(cookie.Cookie[:clientCookieLen], known.client) {
+			return errBadCookie
+		}
+		known.server = cookie.Cookie[clientCookieLen:]
+		return nil
+	}
+	return nil
+}
+
+// strip removes from resp the cookie meant for us, and its OPT record if the client didn't use EDNS0.
+func (c *cookies) strip(resp *dns.Msg, r *dns.Msg) {
+	if r.IsEdns0() != nil {
+		if opt := resp.IsEdns0(); opt != nil {
+			removeCookie(opt)
+		}
+		return
+	}
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+}
+
+func removeCookie(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0COOKIE {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
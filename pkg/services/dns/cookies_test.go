@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+const serverCookie = "0102030405060708"
+
+func requestCookie(r *dns.Msg) string {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+func replyWithCookie(r *dns.Msg, cookie string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return m
+}
+
+var _ = ginkgo.Describe("dns cookies", func() {
+	var (
+		server   *Server
+		upstream *dns.Server
+		queries  int32
+	)
+
+	startUpstream := func(handler dns.HandlerFunc) {
+		upstream = startDNSServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			handler(w, r)
+		})
+		server.handler.nameservers = []string{upstream.PacketConn.LocalAddr().String()}
+	}
+
+	ginkgo.BeforeEach(func() {
+		atomic.StoreInt32(&queries, 0)
+		server = newTestServer([]types.Zone{}, WithCookies(), WithUpstream(unreachableUpstream))
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = upstream.Shutdown()
+	})
+
+	ginkgo.It("should retry with the server cookie after BADCOOKIE", func() {
+		startUpstream(func(w dns.ResponseWriter, r *dns.Msg) {
+			cookie := requestCookie(r)
+			if len(cookie) != clientCookieLen+len(serverCookie) {
+				m := replyWithCookie(r, cookie[:clientCookieLen]+serverCookie)
+				m.Rcode = dns.RcodeBadCookie
+				_ = w.WriteMsg(m)
+				return
+			}
+			m := replyWithCookie(r, cookie)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.0.0.1"),
+			})
+			_ = w.WriteMsg(m)
+		})
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.IsEdns0()).To(gomega.BeNil())
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(2)))
+
+		// the server cookie is known for the next queries
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.org.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(3)))
+	})
+
+	ginkgo.It("should drop responses with a wrong client cookie", func() {
+		startUpstream(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(replyWithCookie(r, "ffffffffffffffff"+serverCookie))
+		})
+
+		_, err := server.handler.exchange(context.Background(), server.handler.udpClient, query("example.com.", dns.TypeA))
+		gomega.Expect(err).To(gomega.MatchError(errBadCookie))
+	})
+})
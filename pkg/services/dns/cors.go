@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSConfig allows browsers to call the HTTP API from other origins.
+type CORSConfig struct {
+	// Origins allowed to call the API, "*" allows any origin
+	AllowedOrigins []string
+	// Defaults to the methods of the API: GET, POST, PUT and OPTIONS
+	AllowedMethods []string
+	// Defaults to Authorization and Content-Type
+	AllowedHeaders []string
+}
+
+func (c *CORSConfig) allowedOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// handler adds the CORS headers to the responses of next, and answers the
+// preflight requests of the allowed origins.
+func (c *CORSConfig) handler(next http.Handler) http.Handler {
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodOptions}
+	}
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Authorization", "Content-Type"}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !c.allowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
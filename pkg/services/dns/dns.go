@@ -2,268 +2,1363 @@ package dns
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/http"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// upstreamTimeout bounds the time spent waiting for the upstream nameserver.
+	upstreamTimeout = 5 * time.Second
+)
+
+var (
+	errTooManyUpstreamQueries = errors.New("too many upstream queries")
+	errBogusResponse          = errors.New("bogus upstream response")
+	errNoUpstream             = errors.New("no upstream nameserver")
+)
+
 type dnsHandler struct {
+	// zones is replaced and never modified in place, lookups use a
+	// snapshot of it without holding zonesLock.
 	zones     []types.Zone
 	zonesLock sync.RWMutex
+	// called with a copy of the zones after each update, nil if none
+	onZoneChange func(zones []types.Zone)
+
+	udpClient Exchanger
+	tcpClient Exchanger
+	// sends the queries to the forwarders of the zones, over plain DNS even
+	// when the upstream nameservers are reached over TLS or HTTPS
+	forwarderClient Exchanger
+	// the upstream nameservers, in order of preference
+	nameservers []string
+	// the health of the upstream nameservers, by address
+	upstreamHealth map[string]*upstreamHealth
+	// guards nameservers and upstreamHealth, which can change at runtime
+	nameserverLock sync.RWMutex
+	// defaultTTL is the TTL of the local answers, unless their zone or record has one
+	defaultTTL uint32
+	// the TTLs of the forwarded answers are kept between minTTL and maxTTL, unless 0
+	minTTL uint32
+	maxTTL uint32
+	cache  *cache
+	// upstream exchanges in progress, by query
+	flights     map[cacheKey]*flight
+	flightsLock sync.Mutex
+	// forwarded answers made only of these addresses are rewritten to NXDOMAIN, keyed by IP.String()
+	bogusNXDomain map[string]bool
+	// slots of the queries in flight to the upstream nameserver, nil when
+	// unlimited. Without queueUpstream, the queries finding no free slot fail.
+	upstreamSlots chan struct{}
+	queueUpstream bool
+	// tells the clients whether the forwarded answers come from the cache, for debugging
+	cacheStatus bool
+	// nil unless DNS cookies are enabled
+	cookies *cookies
+	tracer  Tracer
+	// redact rewrites the query names recorded in the logs and the traces
+	redact NameRedactor
+	// nameservers answered to the NS queries of the root zone, refused when empty
+	rootHints []string
+	// answered to the CHAOS queries identifying the server, refused when empty
+	chaosVersion  string
+	chaosHostname string
+	// nil unless names are resolved from a hosts file
+	hostsFile HostsFile
+	// nil unless names are filtered
+	blocklist *Blocklist
+
+	// queries missing the local zones are answered with missRcode when not forwarded
+	forwarding bool
+	missRcode  int
+	// names under these suffixes are answered with missRcode instead of being forwarded
+	localOnly []string
+
+	// order of the records of the answers, the shuffling uses rand
+	order    AnswerOrder
+	rand     *rand.Rand
+	randLock sync.Mutex
+
+	// ctx is cancelled when the server stops, interrupting in-flight upstream queries
+	ctx context.Context
+
+	// responses which could not be written to the clients, updated atomically
+	udpWriteErrors uint64
+	tcpWriteErrors uint64
+	// durations of the queries, from their reception to the write of their response
+	latencies [numSources]latencyHistogram
+	// 1 when the queries are logged, updated atomically
+	queryLog uint32
+	// nil unless the rate of the queries of each client is bounded
+	rateLimiter *rateLimiter
+	// told to the TCP clients asking with the edns-tcp-keepalive option
+	tcpIdleTimeout time.Duration
+	// queries refused or truncated by the rate limiter, updated atomically
+	rateLimitedQueries uint64
 }
 
-func (h *dnsHandler) handle(w dns.ResponseWriter, r *dns.Msg, responseMessageSize int) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.RecursionAvailable = true
-	h.addAnswers(m)
-	edns0 := r.IsEdns0()
-	if edns0 != nil {
+func (h *dnsHandler) handle(w dns.ResponseWriter, dnsClient Exchanger, r *dns.Msg, responseMessageSize int, writeErrors *uint64) {
+	start := time.Now()
+	ctx, span := h.tracer.Start(h.ctx, "dns.query")
+	defer span.End()
+	if len(r.Question) > 0 {
+		span.SetAttribute("dns.qname", h.redact(r.Question[0].Name))
+		span.SetAttribute("dns.qtype", dns.TypeToString[r.Question[0].Qtype])
+	}
+	if addr := w.RemoteAddr(); addr != nil {
+		span.SetAttribute("client.address", addr.String())
+	}
+
+	m, source := h.answer(ctx, dnsClient, remoteIP(w.RemoteAddr()), r)
+	span.SetAttribute("dns.source", sourceNames[source])
+	span.SetAttribute("dns.rcode", dns.RcodeToString[m.Rcode])
+	// the EDNS0 buffer size only matters over UDP, where it can exceed the
+	// default. Truncate compresses m when it is too large, and sets the TC
+	// bit when records still have to be left out.
+	if edns0 := r.IsEdns0(); edns0 != nil && int(edns0.UDPSize()) > responseMessageSize {
 		responseMessageSize = int(edns0.UDPSize())
 	}
+	fitAdditional(m, responseMessageSize)
 	m.Truncate(responseMessageSize)
 	if err := w.WriteMsg(m); err != nil {
+		atomic.AddUint64(writeErrors, 1)
 		log.Error(err)
 	}
+	latency := time.Since(start)
+	h.latencies[source].observe(latency)
+	h.logQuery(w.RemoteAddr(), r, m, source, latency)
 }
 
 func (h *dnsHandler) handleTCP(w dns.ResponseWriter, r *dns.Msg) {
-	h.handle(w, r, dns.MaxMsgSize)
+	w = tcpKeepaliveWriter{ResponseWriter: w, query: r, idleTimeout: h.tcpIdleTimeout}
+	if h.rateLimited(w, r, true) {
+		return
+	}
+	h.handle(w, h.tcpClient, r, dns.MaxMsgSize, &h.tcpWriteErrors)
 }
 
 func (h *dnsHandler) handleUDP(w dns.ResponseWriter, r *dns.Msg) {
-	h.handle(w, r, dns.MinMsgSize)
+	if h.rateLimited(w, r, false) {
+		return
+	}
+	h.handle(w, h.udpClient, r, dns.MinMsgSize, &h.udpWriteErrors)
 }
 
-func (h *dnsHandler) addAnswers(m *dns.Msg) {
-	h.zonesLock.RLock()
-	defer h.zonesLock.RUnlock()
+// addAnswers answers r, from the local zones or from the upstream nameserver.
+// client is the address of the client which sent r, it can be nil if unknown.
+func (h *dnsHandler) addAnswers(ctx context.Context, dnsClient Exchanger, client net.IP, r *dns.Msg) *dns.Msg {
+	m, _ := h.answer(ctx, dnsClient, client, r)
+	return m
+}
+
+// answer is addAnswers, also returning what answered r.
+func (h *dnsHandler) answer(ctx context.Context, dnsClient Exchanger, client net.IP, r *dns.Msg) (*dns.Msg, querySource) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	// recursion is only available when the queries can be forwarded
+	m.RecursionAvailable = h.forwarding
+	if len(r.Question) == 0 {
+		m.Rcode = dns.RcodeFormatError
+		return m, sourceLocal
+	}
+	for _, q := range m.Question {
+		// empty names, labels over 63 bytes, names over 255 bytes
+		if _, ok := dns.IsDomainName(q.Name); !ok {
+			m.Rcode = dns.RcodeFormatError
+			return m, sourceLocal
+		}
+	}
+	if h.addChaosAnswers(m, r) || h.addRootAnswers(m, r) {
+		return m, sourceLocal
+	}
+	if source, ok := h.addAllLocalAnswers(ctx, m, client); ok {
+		h.resolveCNAME(ctx, dnsClient, m, r)
+		h.orderAnswers(m)
+		return m, source
+	}
+	// the local answers are given even for the blocked names
+	if h.addBlockedAnswers(m, r) {
+		return m, sourceBlocklist
+	}
+	// without recursion desired, only the local answers are given
+	switch {
+	case !h.forwarding:
+		m.Rcode = h.missRcode
+		addExtendedError(m, r, dns.ExtendedErrorCodeNotAuthoritative, "forwarding is disabled")
+		return m, sourceLocal
+	case !r.RecursionDesired:
+		m.Rcode = h.missRcode
+		addExtendedError(m, r, dns.ExtendedErrorCodeNotAuthoritative, "recursion not desired")
+		return m, sourceLocal
+	case h.isLocalOnly(r):
+		m.Rcode = h.missRcode
+		addExtendedError(m, r, dns.ExtendedErrorCodeBlocked, "local-only name")
+		return m, sourceLocal
+	}
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeNameError
+		return m, sourceLocal
+	}
+	resp, source := h.forward(ctx, dnsClient, r)
+	matchQuery(resp, r)
+	resp.RecursionAvailable = true
+	h.orderAnswers(resp)
+	return resp, source
+}
+
+// addRootAnswers answers the NS queries of the root zone with the root hints,
+// or refuses them. It returns false if r is not such a query.
+func (h *dnsHandler) addRootAnswers(m *dns.Msg, r *dns.Msg) bool {
+	if len(r.Question) != 1 || r.Question[0].Name != "." || r.Question[0].Qtype != dns.TypeNS || r.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	if len(h.rootHints) == 0 {
+		m.Rcode = dns.RcodeRefused
+		return true
+	}
+	for _, ns := range h.rootHints {
+		m.Answer = append(m.Answer, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    h.defaultTTL,
+			},
+			Ns: ns,
+		})
+	}
+	return true
+}
+
+// matchQuery gives m, an answer of the upstream nameserver or of the cache,
+// the ID, the question and the flags of the query r. The upstream may not
+// echo them faithfully, and the cache answers the queries for the same name
+// in any case.
+func matchQuery(m *dns.Msg, r *dns.Msg) {
+	m.Id = r.Id
+	m.Opcode = r.Opcode
+	m.RecursionDesired = r.RecursionDesired
+	m.CheckingDisabled = r.CheckingDisabled
+	m.Question = append([]dns.Question(nil), r.Question...)
+	opt := r.IsEdns0()
+	// the answers are only told to be validated to the clients asking for it (RFC 6840 section 5.8)
+	if !r.AuthenticatedData && (opt == nil || !opt.Do()) {
+		m.AuthenticatedData = false
+	}
+	// the clients not using EDNS0 must not get an OPT record (RFC 6891 section 7)
+	if opt == nil {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+	}
+}
+
+// addAllLocalAnswers answers the questions of m from the local zones or from
+// the hosts file. It returns true, and which of them answered, if one of the
+// questions belongs to a local zone or is a name of the hosts file.
+func (h *dnsHandler) addAllLocalAnswers(ctx context.Context, m *dns.Msg, client net.IP) (querySource, bool) {
+	_, span := h.tracer.Start(ctx, "dns.local")
+	for _, q := range m.Question {
+		if h.addLocalAnswers(m, q, client) {
+			h.chaseCNAME(m, q, client)
+			h.addAdditionalAnswers(m, client)
+			span.SetAttribute("dns.local.answered", "true")
+			span.End()
+			return sourceLocal, true
+		}
+		if h.addZonePTR(m, q) {
+			span.SetAttribute("dns.local.answered", "true")
+			span.End()
+			return sourceLocal, true
+		}
+	}
+	span.SetAttribute("dns.local.answered", "false")
+	span.End()
+
+	if h.hostsFile == nil {
+		return sourceLocal, false
+	}
+	_, span = h.tracer.Start(ctx, "dns.hosts")
+	defer span.End()
 	for _, q := range m.Question {
-		for _, zone := range h.zones {
-			zoneSuffix := fmt.Sprintf(".%s", zone.Name)
-			if strings.HasSuffix(q.Name, zoneSuffix) {
-				if q.Qtype != dns.TypeA {
-					return
+		if h.addHostsFileAnswers(m, q) {
+			span.SetAttribute("dns.hosts.answered", "true")
+			return sourceHosts, true
+		}
+	}
+	span.SetAttribute("dns.hosts.answered", "false")
+	return sourceLocal, false
+}
+
+// maxCNAMEChain is the number of aliases followed to answer a query.
+const maxCNAMEChain = 8
+
+// chaseCNAME adds the answers for the target of the alias answered to q to
+// m, and so on, as long as the targets are in the local zones. The targets
+// out of them are left to the clients to resolve.
+func (h *dnsHandler) chaseCNAME(m *dns.Msg, q dns.Question, client net.IP) {
+	if q.Qtype == dns.TypeCNAME {
+		return
+	}
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	for i := 0; i < maxCNAMEChain && len(m.Answer) > 0; i++ {
+		cname, ok := m.Answer[len(m.Answer)-1].(*dns.CNAME)
+		if !ok || seen[strings.ToLower(cname.Target)] {
+			return
+		}
+		seen[strings.ToLower(cname.Target)] = true
+		target := new(dns.Msg)
+		if !h.addLocalAnswers(target, dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}, client) {
+			return
+		}
+		m.Answer = append(m.Answer, target.Answer...)
+		m.Rcode = target.Rcode
+	}
+}
+
+// resolveCNAME forwards the query for the target of the local alias ending
+// the answers of m when it is out of the local zones, as the stub resolvers
+// of the clients expect the whole chain, and adds the answers to m.
+func (h *dnsHandler) resolveCNAME(ctx context.Context, dnsClient Exchanger, m *dns.Msg, r *dns.Msg) {
+	if len(m.Answer) == 0 || len(r.Question) != 1 || !h.forwarding || !r.RecursionDesired {
+		return
+	}
+	cname, ok := m.Answer[len(m.Answer)-1].(*dns.CNAME)
+	if !ok || (h.inLocalZones(cname.Target) && h.forwarder(cname.Target) == "") {
+		return
+	}
+	target := r.Copy()
+	target.Question[0].Name = cname.Target
+	if h.isLocalOnly(target) {
+		return
+	}
+	resp, _ := h.forward(ctx, dnsClient, target)
+	m.Answer = append(m.Answer, resp.Answer...)
+	m.Rcode = resp.Rcode
+}
+
+// inLocalZones returns true if name is in one of the local zones.
+func (h *dnsHandler) inLocalZones(name string) bool {
+	name = asciiName(name)
+	for _, zone := range h.snapshot() {
+		if _, ok := inZone(name, zone.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addHostsFileAnswers answers A and AAAA queries from the hosts file. Names
+// of the hosts file without an address of the requested family are left to
+// the upstream nameserver, unless the server doesn't forward queries. PTR
+// queries for the addresses of the hosts file are answered with their names.
+func (h *dnsHandler) addHostsFileAnswers(m *dns.Msg, q dns.Question) bool {
+	if q.Qclass == dns.ClassINET && q.Qtype == dns.TypePTR {
+		return h.addHostsFilePTR(m, q)
+	}
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return false
+	}
+	ips := h.hostsFile.LookupByHostname(q.Name)
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    h.defaultTTL,
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+			}
+		} else if q.Qtype == dns.TypeAAAA {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return len(m.Answer) > 0 || !h.forwarding
+}
+
+func (h *dnsHandler) addHostsFilePTR(m *dns.Msg, q dns.Question) bool {
+	ip := reverseIP(q.Name)
+	if ip == nil {
+		return false
+	}
+	names := h.hostsFile.LookupByAddr(ip)
+	for _, name := range names {
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    h.defaultTTL,
+			},
+			Ptr: name,
+		})
+	}
+	return len(names) > 0
+}
+
+// addLocalAnswers answers q from the local zones. It returns true if q
+// belongs to one of them, in which case m must not be forwarded, unless the
+// zone has a forwarder and no record for q. The zones
+// are in the IN class, the queries of other classes for their names are
+// refused.
+func (h *dnsHandler) addLocalAnswers(m *dns.Msg, q dns.Question, client net.IP) bool {
+	// the answers keep the name of the question, whatever its form
+	name := asciiName(q.Name)
+	for _, zone := range h.snapshot() {
+		if withoutZone, ok := inZone(name, zone.Name); ok {
+			if q.Qclass != dns.ClassINET {
+				m.Rcode = dns.RcodeRefused
+				return true
+			}
+			apex := withoutZone == ""
+			if apex && h.addApexAnswers(m, q, zone) {
+				return true
+			}
+			if h.addDelegation(m, q, zone, withoutZone) {
+				return true
+			}
+			matched := false
+			var weighted []weightedIP
+			for _, record := range matchingRecords(zone.Records, withoutZone) {
+				matched = true
+				// an alias answers the queries of any type, the target is chased by addAllLocalAnswers
+				if record.CNAME != "" {
+					m.Answer = append(m.Answer, &dns.CNAME{
+						Hdr: dns.RR_Header{
+							Name:   q.Name,
+							Rrtype: dns.TypeCNAME,
+							Class:  dns.ClassINET,
+							Ttl:    h.recordTTL(zone, record),
+						},
+						Target: dns.Fqdn(record.CNAME),
+					})
+					return true
 				}
-				for _, record := range zone.Records {
-					withoutZone := strings.TrimSuffix(q.Name, zoneSuffix)
-					if (record.Name != "" && record.Name == withoutZone) ||
-						(record.Regexp != nil && record.Regexp.MatchString(withoutZone)) {
-						m.Answer = append(m.Answer, &dns.A{
+				switch q.Qtype {
+				case dns.TypeA, dns.TypeAAAA:
+					// an address of the other family is no data, the name still exists
+					ip := recordIP(record, client, q.Qtype)
+					if ip == nil {
+						continue
+					}
+					if record.Weight > 0 {
+						weighted = append(weighted, weightedIP{ip: ip, weight: int(record.Weight), ttl: h.recordTTL(zone, record)})
+						continue
+					}
+					if len(weighted) > 0 {
+						continue
+					}
+					m.Answer = append(m.Answer, addressRR(q.Name, h.recordTTL(zone, record), ip))
+					return true
+				case dns.TypeTXT:
+					for _, txt := range record.TXT {
+						m.Answer = append(m.Answer, &dns.TXT{
 							Hdr: dns.RR_Header{
 								Name:   q.Name,
-								Rrtype: dns.TypeA,
+								Rrtype: dns.TypeTXT,
 								Class:  dns.ClassINET,
-								Ttl:    0,
+								Ttl:    h.recordTTL(zone, record),
 							},
-							A: record.IP,
+							Txt: splitTXT(txt),
 						})
-						return
+					}
+				case dns.TypeMX:
+					for _, mx := range record.MX {
+						m.Answer = append(m.Answer, &dns.MX{
+							Hdr: dns.RR_Header{
+								Name:   q.Name,
+								Rrtype: dns.TypeMX,
+								Class:  dns.ClassINET,
+								Ttl:    h.recordTTL(zone, record),
+							},
+							Preference: mx.Preference,
+							Mx:         dns.Fqdn(mx.Exchange),
+						})
+					}
+				case dns.TypeSRV:
+					for _, srv := range record.SRV {
+						m.Answer = append(m.Answer, &dns.SRV{
+							Hdr: dns.RR_Header{
+								Name:   q.Name,
+								Rrtype: dns.TypeSRV,
+								Class:  dns.ClassINET,
+								Ttl:    h.recordTTL(zone, record),
+							},
+							Priority: srv.Priority,
+							Weight:   srv.Weight,
+							Port:     srv.Port,
+							Target:   dns.Fqdn(srv.Target),
+						})
+					}
+				case dns.TypeSVCB:
+					for _, svcb := range record.SVCB {
+						m.Answer = append(m.Answer, newSVCB(q.Name, dns.TypeSVCB, h.recordTTL(zone, record), svcb))
+					}
+				case dns.TypeHTTPS:
+					for _, https := range record.HTTPS {
+						m.Answer = append(m.Answer, &dns.HTTPS{SVCB: *newSVCB(q.Name, dns.TypeHTTPS, h.recordTTL(zone, record), https)})
 					}
 				}
-				if !zone.DefaultIP.Equal(net.IP("")) {
-					m.Answer = append(m.Answer, &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeA,
-							Class:  dns.ClassINET,
-							Ttl:    0,
-						},
-						A: zone.DefaultIP,
-					})
-					return
-				}
-				m.Rcode = dns.RcodeNameError
-				return
 			}
-		}
-
-		resolver := net.Resolver{
-			PreferGo: false,
-		}
-		switch q.Qtype {
-		case dns.TypeA:
-			ips, err := resolver.LookupIPAddr(context.TODO(), q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
+			if len(weighted) > 0 {
+				picked := h.pickWeighted(weighted)
+				m.Answer = append(m.Answer, addressRR(q.Name, picked.ttl, picked.ip))
+				return true
 			}
-			for _, ip := range ips {
-				if len(ip.IP.To4()) != net.IPv4len {
-					continue
+			// the names without a record are left to the forwarder of the zone
+			if !matched && zone.Forwarder != "" {
+				return false
+			}
+			// the name exists: answer with its records, or with no data for this
+			// type rather than forwarding the query
+			if matched {
+				if len(m.Answer) == 0 {
+					m.Authoritative = true
 				}
-				m.Answer = append(m.Answer, &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    0,
-					},
-					A: ip.IP.To4(),
-				})
+				return true
 			}
-		case dns.TypeCNAME:
-			cname, err := resolver.LookupCNAME(context.TODO(), q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
+			// without a default IP the name doesn't exist, whatever the type, but the apex always does
+			if len(zone.DefaultIP) == 0 && len(zone.DefaultIPv6) == 0 {
+				if !apex {
+					m.Rcode = dns.RcodeNameError
+				}
+				m.Authoritative = true
+				return true
 			}
-			m.Answer = append(m.Answer, &dns.CNAME{
+			// the default IP makes every name of the zone exist, with no data for the other types
+			if rr := h.defaultIPAnswer(q, zone); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			} else {
+				m.Authoritative = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// splitTXT splits txt into the strings of at most 255 bytes of a TXT record.
+func splitTXT(txt string) []string {
+	strs := []string{}
+	for len(txt) > 255 {
+		strs = append(strs, txt[:255])
+		txt = txt[255:]
+	}
+	return append(strs, txt)
+}
+
+// newSVCB returns the SVCB record of name for svcb, with the HTTPS type if rrtype is TypeHTTPS.
+func newSVCB(name string, rrtype uint16, ttl uint32, svcb types.SVCBRecord) *dns.SVCB {
+	rr := &dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Priority: svcb.Priority,
+		Target:   dns.Fqdn(svcb.Target),
+	}
+	// the parameters must be sorted by key
+	if len(svcb.ALPN) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBAlpn{Alpn: svcb.ALPN})
+	}
+	if svcb.Port != 0 {
+		rr.Value = append(rr.Value, &dns.SVCBPort{Port: svcb.Port})
+	}
+	if len(svcb.IPv4Hint) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBIPv4Hint{Hint: svcb.IPv4Hint})
+	}
+	if len(svcb.IPv6Hint) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBIPv6Hint{Hint: svcb.IPv6Hint})
+	}
+	return rr
+}
+
+// inZone returns the part of name before the zone called zoneName, empty at
+// its apex, and false if name is not in this zone.
+func inZone(name string, zoneName string) (string, bool) {
+	// the apex of the zone is its name itself
+	if name == zoneName {
+		return "", true
+	}
+	zoneSuffix := fmt.Sprintf(".%s", zoneName)
+	if !strings.HasSuffix(name, zoneSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, zoneSuffix), true
+}
+
+// isLocalOnly returns true if a question of r is under a local-only suffix.
+// The names are compared regardless of their case and IDN form, a variation
+// of a local-only name must not leak either.
+func (h *dnsHandler) isLocalOnly(r *dns.Msg) bool {
+	for _, q := range r.Question {
+		name := strings.ToLower(asciiName(q.Name))
+		for _, suffix := range h.localOnly {
+			if _, ok := inZone(name, suffix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addApexAnswers answers the SOA and NS queries at the apex of zone with its
+// configured values. It returns false if zone has none for q.
+func (h *dnsHandler) addApexAnswers(m *dns.Msg, q dns.Question, zone types.Zone) bool {
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    h.zoneTTL(zone),
+	}
+	switch {
+	case q.Qtype == dns.TypeSOA && zone.SOA != nil:
+		m.Answer = append(m.Answer, &dns.SOA{
+			Hdr:     hdr,
+			Ns:      dns.Fqdn(zone.SOA.Ns),
+			Mbox:    dns.Fqdn(zone.SOA.Mbox),
+			Serial:  zone.SOA.Serial,
+			Refresh: zone.SOA.Refresh,
+			Retry:   zone.SOA.Retry,
+			Expire:  zone.SOA.Expire,
+			Minttl:  zone.SOA.Minttl,
+		})
+	case q.Qtype == dns.TypeNS && len(zone.NS) > 0:
+		for _, ns := range zone.NS {
+			m.Answer = append(m.Answer, &dns.NS{Hdr: hdr, Ns: dns.Fqdn(ns)})
+		}
+	default:
+		return false
+	}
+	m.Authoritative = true
+	return true
+}
+
+// defaultIPAnswer returns the answer to q with the default IP of zone of the
+// requested family, or nil if there is none or q is about another type.
+func (h *dnsHandler) defaultIPAnswer(q dns.Question, zone types.Zone) dns.RR {
+	hdr := dns.RR_Header{
+		Name:  q.Name,
+		Class: dns.ClassINET,
+		Ttl:   h.defaultIPTTL(zone),
+	}
+	switch q.Qtype {
+	case dns.TypeA:
+		if ip4 := zone.DefaultIP.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			return &dns.A{Hdr: hdr, A: ip4}
+		}
+	case dns.TypeAAAA:
+		ip6 := zone.DefaultIPv6
+		if len(ip6) == 0 && len(zone.DefaultIP) > 0 && zone.DefaultIP.To4() == nil {
+			ip6 = zone.DefaultIP
+		}
+		if len(ip6) > 0 {
+			hdr.Rrtype = dns.TypeAAAA
+			return &dns.AAAA{Hdr: hdr, AAAA: ip6}
+		}
+	}
+	return nil
+}
+
+// addDelegation answers with a referral to the nameservers of the delegated
+// subdomain of zone containing name, if any.
+func (h *dnsHandler) addDelegation(m *dns.Msg, q dns.Question, zone types.Zone, name string) bool {
+	for _, record := range zone.Records {
+		if len(record.NS) == 0 || record.Name == "" {
+			continue
+		}
+		if name != record.Name && !strings.HasSuffix(name, "."+record.Name) {
+			continue
+		}
+		owner := record.Name + "." + zone.Name
+		var ns []dns.RR
+		for _, nameserver := range record.NS {
+			ns = append(ns, &dns.NS{
 				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeCNAME,
+					Name:   owner,
+					Rrtype: dns.TypeNS,
 					Class:  dns.ClassINET,
-					Ttl:    0,
+					Ttl:    h.recordTTL(zone, record),
 				},
-				Target: cname,
+				Ns: dns.Fqdn(nameserver.Host),
 			})
-		case dns.TypeMX:
-			records, err := resolver.LookupMX(context.TODO(), q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
-			}
-			for _, mx := range records {
-				m.Answer = append(m.Answer, &dns.MX{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeMX,
-						Class:  dns.ClassINET,
-						Ttl:    0,
-					},
-					Mx:         mx.Host,
-					Preference: mx.Pref,
-				})
-			}
-		case dns.TypeNS:
-			records, err := resolver.LookupNS(context.TODO(), q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
-			}
-			for _, ns := range records {
-				m.Answer = append(m.Answer, &dns.NS{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeNS,
-						Class:  dns.ClassINET,
-						Ttl:    0,
-					},
-					Ns: ns.Host,
-				})
-			}
-		case dns.TypeSRV:
-			_, records, err := resolver.LookupSRV(context.TODO(), "", "", q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
+			if nameserver.IP == nil {
+				continue
 			}
-			for _, srv := range records {
-				m.Answer = append(m.Answer, &dns.SRV{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeSRV,
-						Class:  dns.ClassINET,
-						Ttl:    0,
-					},
-					Port:     srv.Port,
-					Priority: srv.Priority,
-					Target:   srv.Target,
-					Weight:   srv.Weight,
-				})
-			}
-		case dns.TypeTXT:
-			records, err := resolver.LookupTXT(context.TODO(), q.Name)
-			if err != nil {
-				m.Rcode = dns.RcodeNameError
-				return
-			}
-			m.Answer = append(m.Answer, &dns.TXT{
+			glue := &dns.A{
 				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeTXT,
+					Name:   dns.Fqdn(nameserver.Host),
+					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    0,
+					Ttl:    h.recordTTL(zone, record),
 				},
-				Txt: records,
-			})
+				A: nameserver.IP,
+			}
+			m.Extra = append(m.Extra, glue)
+		}
+		if q.Qtype == dns.TypeNS && name == record.Name {
+			m.Answer = append(m.Answer, ns...)
+		} else {
+			m.Ns = append(m.Ns, ns...)
 		}
+		return true
 	}
+	return false
+}
+
+// recordTTL returns the TTL of the answers from record, the one of the
+// record, else the one of its zone, else the default one.
+func (h *dnsHandler) recordTTL(zone types.Zone, record types.Record) uint32 {
+	if record.TTL != 0 {
+		return record.TTL
+	}
+	return h.zoneTTL(zone)
+}
+
+func (h *dnsHandler) defaultIPTTL(zone types.Zone) uint32 {
+	if zone.DefaultTTL != 0 {
+		return zone.DefaultTTL
+	}
+	return h.zoneTTL(zone)
+}
+
+func (h *dnsHandler) zoneTTL(zone types.Zone) uint32 {
+	if zone.TTL != 0 {
+		return zone.TTL
+	}
+	return h.defaultTTL
+}
+
+type weightedIP struct {
+	ip     net.IP
+	weight int
+	ttl    uint32
+}
+
+// pickWeighted chooses one of ips with a probability proportional to its weight.
+func (h *dnsHandler) pickWeighted(ips []weightedIP) weightedIP {
+	total := 0
+	for _, ip := range ips {
+		total += ip.weight
+	}
+	h.randLock.Lock()
+	n := h.rand.Intn(total)
+	h.randLock.Unlock()
+	for _, ip := range ips {
+		if n < ip.weight {
+			return ip
+		}
+		n -= ip.weight
+	}
+	return ips[len(ips)-1]
+}
+
+// matchingRecords returns the records of name, in the order of records: the
+// ones with this exact name if any, the ones matching it with a regexp or a
+// glob otherwise.
+func matchingRecords(records []types.Record, name string) []types.Record {
+	var exact, patterns []types.Record
+	for _, record := range records {
+		switch {
+		case record.Name != "" && record.Name == name:
+			exact = append(exact, record)
+		case matchRecord(record, name):
+			patterns = append(patterns, record)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return patterns
+}
+
+func matchRecord(record types.Record, name string) bool {
+	return (record.Name != "" && record.Name == name) ||
+		(record.Regexp != nil && record.Regexp.MatchString(name)) ||
+		(record.Glob != "" && matchGlob(record.Glob, name))
+}
+
+// matchGlob returns true if name matches the shell pattern glob. A * also
+// matches the dots between labels.
+func matchGlob(glob string, name string) bool {
+	matched, err := path.Match(glob, name)
+	return err == nil && matched
+}
+
+// recordIP returns the address of record answered over qtype, A or AAAA, to
+// client: the IP of the first view matching client with an address of this
+// family, or else the IP or IPv6 of record. It returns nil if there is none.
+func recordIP(record types.Record, client net.IP, qtype uint16) net.IP {
+	if client != nil {
+		for _, view := range record.Views {
+			_, subnet, err := net.ParseCIDR(view.Subnet)
+			if err == nil && subnet.Contains(client) {
+				if ip := addressOf(view.IP, qtype); ip != nil {
+					return ip
+				}
+			}
+		}
+	}
+	if ip := addressOf(record.IP, qtype); ip != nil {
+		return ip
+	}
+	return addressOf(record.IPv6, qtype)
+}
+
+// addressOf returns ip if it is an address answered over qtype, A or AAAA.
+func addressOf(ip net.IP, qtype uint16) net.IP {
+	if len(ip) == 0 {
+		return nil
+	}
+	ip4 := ip.To4()
+	switch {
+	case qtype == dns.TypeA:
+		return ip4
+	case qtype == dns.TypeAAAA && ip4 == nil:
+		return ip
+	}
+	return nil
+}
+
+// addressRR returns the A or AAAA record of name for ip, depending on its family.
+func addressRR(name string, ttl uint32, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   ttl,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip4}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// forward sends r to the upstream nameserver, serving it from the cache when
+// possible, and returns whether the cache or the upstream nameserver answered.
+func (h *dnsHandler) forward(ctx context.Context, dnsClient Exchanger, r *dns.Msg) (*dns.Msg, querySource) {
+	key := queryCacheKey(r)
+	cached, state, refresh := h.cache.get(key)
+	if state != cacheMiss {
+		if refresh {
+			go h.refresh(dnsClient, key, r.Copy())
+		}
+		h.addCacheStatus(cached, r, state)
+		return cached, sourceCache
+	}
+
+	ctx, span := h.tracer.Start(ctx, "dns.upstream")
+	defer span.End()
+	span.SetAttribute("dns.upstream", h.upstreamFor(r))
+	// the identical queries arriving meanwhile share the exchange and its answer
+	resp, err := h.sharedExchange(ctx, key, func() (*dns.Msg, error) {
+		if !h.acquireUpstream(ctx) {
+			return nil, errTooManyUpstreamQueries
+		}
+		resp, err := h.exchange(ctx, dnsClient, r)
+		h.releaseUpstream()
+		if err != nil {
+			return nil, err
+		}
+		h.rewriteBogusNXDomain(resp)
+		h.clampTTL(resp)
+		h.cache.set(key, resp)
+		return resp, nil
+	})
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		m.Rcode = dns.RcodeServerFailure
+		if errors.Is(err, errTooManyUpstreamQueries) {
+			addExtendedError(m, r, dns.ExtendedErrorCodeOther, "too many upstream queries")
+			return m, sourceUpstream
+		}
+		if errors.Is(err, errBogusResponse) {
+			log.Debugf("%v for %s from %s", err, h.redact(r.Question[0].Name), h.upstreamFor(r))
+			addExtendedError(m, r, dns.ExtendedErrorCodeInvalidData, "invalid upstream response")
+			return m, sourceUpstream
+		}
+		log.Debugf("error during DNS exchange for %s with %s: %v", h.redact(r.Question[0].Name), h.upstreamFor(r), err)
+		addExtendedError(m, r, dns.ExtendedErrorCodeNetworkError, "upstream nameserver unreachable")
+		return m, sourceUpstream
+	}
+	span.SetAttribute("dns.rcode", dns.RcodeToString[resp.Rcode])
+	h.addCacheStatus(resp, r, cacheMiss)
+	return resp, sourceUpstream
+}
+
+// refresh updates a cache entry in the background. On failure, the
+// entry is kept and served until it is past the max stale duration.
+func (h *dnsHandler) refresh(dnsClient Exchanger, key cacheKey, r *dns.Msg) {
+	if !h.acquireUpstream(h.ctx) {
+		log.Debugf("cannot refresh stale DNS answer for %s: too many upstream queries", h.redact(key.name))
+		h.cache.refreshFailed(key)
+		return
+	}
+	resp, err := h.exchange(h.ctx, dnsClient, r)
+	h.releaseUpstream()
+	if err != nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		log.Debugf("cannot refresh stale DNS answer for %s: %v", h.redact(key.name), err)
+		h.cache.refreshFailed(key)
+		return
+	}
+	h.rewriteBogusNXDomain(resp)
+	h.clampTTL(resp)
+	h.cache.set(key, resp)
+}
+
+// addCacheStatus tells the client whether m, the response to r, was served
+// from the cache, when enabled.
+func (h *dnsHandler) addCacheStatus(m *dns.Msg, r *dns.Msg, state cacheState) {
+	if !h.cacheStatus {
+		return
+	}
+	log.Debugf("cache %s for %s", cacheStates[state], h.redact(r.Question[0].Name))
+	addCacheStatus(m, r, state)
+}
+
+// acquireUpstream takes a slot for a query to the upstream nameserver. It
+// returns false if none is free, after waiting for one up to upstreamTimeout
+// when the queries are queued.
+func (h *dnsHandler) acquireUpstream(ctx context.Context) bool {
+	if h.upstreamSlots == nil {
+		return true
+	}
+	if !h.queueUpstream {
+		select {
+		case h.upstreamSlots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	select {
+	case h.upstreamSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (h *dnsHandler) releaseUpstream() {
+	if h.upstreamSlots != nil {
+		<-h.upstreamSlots
+	}
+}
+
+// rewriteBogusNXDomain turns resp into NXDOMAIN when its addresses are all
+// bogus, as answered by upstreams redirecting the missing names to their own
+// servers.
+func (h *dnsHandler) rewriteBogusNXDomain(resp *dns.Msg) {
+	if len(h.bogusNXDomain) == 0 || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+	bogus := false
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !h.bogusNXDomain[ip.String()] {
+			return
+		}
+		bogus = true
+	}
+	if bogus {
+		resp.Rcode = dns.RcodeNameError
+		resp.Answer = nil
+	}
+}
+
+// clampTTL keeps the TTLs of the records of resp between minTTL and maxTTL.
+func (h *dnsHandler) clampTTL(resp *dns.Msg) {
+	for _, rr := range records(resp) {
+		if ttl := rr.Header().Ttl; ttl < h.minTTL {
+			rr.Header().Ttl = h.minTTL
+		} else if h.maxTTL != 0 && ttl > h.maxTTL {
+			rr.Header().Ttl = h.maxTTL
+		}
+	}
+}
+
+// exchange sends r to the forwarder of its zone, or to the upstream
+// nameservers, trying the next one when one fails, the ones known to be down
+// last.
+func (h *dnsHandler) exchange(ctx context.Context, dnsClient Exchanger, r *dns.Msg) (*dns.Msg, error) {
+	nameservers := h.upstreamOrder()
+	if forwarder := h.forwarder(r.Question[0].Name); forwarder != "" {
+		// the forwarders of the zones are plain nameservers, whatever the
+		// transport to the upstream ones
+		nameservers = []string{forwarder}
+		dnsClient = h.forwarderClient
+	}
+	if len(nameservers) == 0 {
+		return nil, errNoUpstream
+	}
+	var err error
+	for _, nameserver := range nameservers {
+		var resp *dns.Msg
+		resp, err = h.exchangeWith(ctx, dnsClient, r, nameserver)
+		if err != nil && ctx.Err() != nil {
+			// the client gave up, the nameserver may be fine
+			return nil, err
+		}
+		h.reportUpstream(nameserver, err)
+		if err == nil {
+			return resp, nil
+		}
+		log.Debugf("upstream nameserver %s failed: %v", nameserver, err)
+	}
+	return nil, err
+}
+
+// exchangeWith sends r to nameserver, with a DNS cookie if enabled.
+func (h *dnsHandler) exchangeWith(ctx context.Context, dnsClient Exchanger, r *dns.Msg, nameserver string) (*dns.Msg, error) {
+	if h.cookies == nil {
+		return h.roundTrip(ctx, dnsClient, r, nameserver)
+	}
+	// a second attempt is needed when the upstream gave us a new server cookie with BADCOOKIE
+	for attempt := 0; ; attempt++ {
+		msg, err := h.cookies.add(r, nameserver)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := h.roundTrip(ctx, dnsClient, msg, nameserver)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.cookies.check(resp, nameserver); err != nil {
+			return nil, err
+		}
+		if resp.Rcode == dns.RcodeBadCookie && attempt == 0 {
+			continue
+		}
+		h.cookies.strip(resp, r)
+		if resp.Rcode == dns.RcodeBadCookie {
+			resp.Rcode = dns.RcodeServerFailure
+			addExtendedError(resp, r, dns.ExtendedErrorCodeNetworkError, "upstream nameserver rejected the DNS cookie")
+		}
+		return resp, nil
+	}
+}
+
+// roundTrip sends r to the upstream nameserver. It gives up after
+// upstreamTimeout or as soon as ctx is cancelled.
+func (h *dnsHandler) roundTrip(ctx context.Context, dnsClient Exchanger, r *dns.Msg, nameserver string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	resp, _, err := dnsClient.ExchangeContext(ctx, r, nameserver)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, r); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkResponse returns an error if resp, from the upstream nameserver, is
+// not the response to r. Its question may be left out on errors.
+func checkResponse(resp *dns.Msg, r *dns.Msg) error {
+	switch {
+	case resp == nil:
+		return fmt.Errorf("%w: no message", errBogusResponse)
+	case !resp.Response:
+		return fmt.Errorf("%w: not a response", errBogusResponse)
+	case resp.Id != r.Id:
+		return fmt.Errorf("%w: id %d instead of %d", errBogusResponse, resp.Id, r.Id)
+	case resp.Opcode != r.Opcode:
+		return fmt.Errorf("%w: opcode %s instead of %s", errBogusResponse, dns.OpcodeToString[resp.Opcode], dns.OpcodeToString[r.Opcode])
+	case len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess:
+		return nil
+	case len(resp.Question) != len(r.Question):
+		return fmt.Errorf("%w: %d questions instead of %d", errBogusResponse, len(resp.Question), len(r.Question))
+	}
+	for i, q := range resp.Question {
+		if !strings.EqualFold(q.Name, r.Question[i].Name) || q.Qtype != r.Question[i].Qtype || q.Qclass != r.Question[i].Qclass {
+			return fmt.Errorf("%w: question %s %s instead of %s %s", errBogusResponse,
+				q.Name, dns.TypeToString[q.Qtype], r.Question[i].Name, dns.TypeToString[r.Question[i].Qtype])
+		}
+	}
+	return nil
 }
 
 type Server struct {
 	udpConn net.PacketConn
 	tcpLn   net.Listener
 	handler *dnsHandler
+
+	// bearer token required by the HTTP API
+	apiToken         string
+	apiTokenForReads bool
+	// nil unless the HTTP API can be called from browsers
+	cors *CORSConfig
+
+	tcpOptions TCPOptions
+
+	// discoverUpstream returns the addresses of the nameservers configured on the host
+	discoverUpstream func() ([]string, error)
+	// port of the upstream nameservers given without one
+	upstreamPort string
+
+	// closed once Serve and ServeTCP are listening
+	udpReady, tcpReady         chan struct{}
+	udpReadyOnce, tcpReadyOnce sync.Once
 }
 
-func New(udpConn net.PacketConn, tcpLn net.Listener, zones []types.Zone) (*Server, error) {
-	handler := &dnsHandler{zones: zones}
-	return &Server{udpConn: udpConn, tcpLn: tcpLn, handler: handler}, nil
+func New(udpConn net.PacketConn, tcpLn net.Listener, zones []types.Zone, opts ...Option) (*Server, error) {
+	handler := &dnsHandler{
+		zones:          normalizeZones(zones),
+		udpClient:      client{&dns.Client{Net: "udp"}},
+		tcpClient:      newPooledClient(&dns.Client{Net: "tcp"}),
+		cache:          newCache(),
+		flights:        map[cacheKey]*flight{},
+		ctx:            context.Background(),
+		tracer:         noopTracer{},
+		redact:         noRedaction,
+		forwarding:     true,
+		missRcode:      dns.RcodeRefused,
+		tcpIdleTimeout: defaultTCPIdleTimeout,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- no need for a secure source to spread answers
+	}
+	handler.forwarderClient = plainClient{udp: handler.udpClient, tcp: handler.tcpClient}
+	s := &Server{
+		udpConn:  udpConn,
+		tcpLn:    tcpLn,
+		handler:  handler,
+		udpReady: make(chan struct{}),
+		tcpReady: make(chan struct{}),
+
+		discoverUpstream: discoverUpstreams,
+		upstreamPort:     "53",
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// an authoritative-only server needs no upstream nameserver
+	if len(handler.nameservers) == 0 && handler.forwarding {
+		// the host may be offline: the forwarded queries fail until
+		// RefreshUpstream or WatchUpstream find a nameserver
+		if err := s.RefreshUpstream(); err != nil {
+			log.Warnf("starting without upstream nameserver: %v", err)
+		}
+	}
+	return s, nil
 }
 
-func (s *Server) Serve() error {
-	mux := dns.NewServeMux()
-	mux.HandleFunc(".", s.handler.handleUDP)
-	srv := &dns.Server{
-		PacketConn: s.udpConn,
-		Handler:    mux,
+// SetUpstream forwards the next queries to the nameserver at address, a host
+// with an optional port, 53 by default or 853 over TLS, or the URL of a DNS
+// over HTTPS endpoint. The queries in flight are left to the previous one.
+func (s *Server) SetUpstream(address string) {
+	s.SetUpstreams(address)
+}
+
+// SetUpstreams forwards the next queries to the nameservers at addresses, as
+// given to SetUpstream. They are tried in order: a nameserver failing to
+// answer is only tried after the others until it answers again.
+func (s *Server) SetUpstreams(addresses ...string) {
+	nameservers := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil && !strings.Contains(address, "://") {
+			address = net.JoinHostPort(strings.Trim(address, "[]"), s.upstreamPort)
+		}
+		nameservers = append(nameservers, address)
 	}
-	return srv.ActivateAndServe()
+	s.handler.setUpstreams(nameservers)
 }
 
-func (s *Server) ServeTCP() error {
-	mux := dns.NewServeMux()
-	mux.HandleFunc(".", s.handler.handleTCP)
-	tcpSrv := &dns.Server{
-		Listener: s.tcpLn,
-		Handler:  mux,
+// RefreshUpstream forwards the next queries to the nameservers configured on
+// the host, such as after a VPN changed them.
+func (s *Server) RefreshUpstream() error {
+	nameservers, err := s.discoverUpstream()
+	if err != nil {
+		return err
 	}
-	return tcpSrv.ActivateAndServe()
+	s.SetUpstreams(nameservers...)
+	return nil
 }
 
-func (s *Server) Mux() http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/all", func(w http.ResponseWriter, r *http.Request) {
-		s.handler.zonesLock.RLock()
-		_ = json.NewEncoder(w).Encode(s.handler.zones)
-		s.handler.zonesLock.RUnlock()
-	})
+// discoverUpstreams returns the addresses of the nameservers configured on
+// the host.
+func discoverUpstreams() ([]string, error) {
+	conf, err := GetSystemConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Servers) == 0 {
+		return nil, errors.New("no nameserver found in " + conf.Source)
+	}
+	nameservers := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(server, conf.Port))
+	}
+	return nameservers, nil
+}
 
-	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
+// FlushCache forgets the cached answers for domain and the names under it,
+// or all of them if domain is empty, so that the next queries are forwarded
+// to the upstream nameserver. It returns the number of answers forgotten.
+func (s *Server) FlushCache(domain string) int {
+	if domain != "" {
+		domain = dns.Fqdn(domain)
+	}
+	return s.handler.cache.flush(domain)
+}
+
+func (s *Server) Serve() error {
+	return s.udpServer().ActivateAndServe()
+}
+
+// Ready returns a channel closed once Serve answers queries.
+func (s *Server) Ready() <-chan struct{} {
+	return s.udpReady
+}
+
+// ReadyTCP returns a channel closed once ServeTCP answers queries.
+func (s *Server) ReadyTCP() <-chan struct{} {
+	return s.tcpReady
+}
+
+func (s *Server) ServeTCP() error {
+	return s.tcpServer().ActivateAndServe()
+}
+
+// ListenAndServe answers the queries over both UDP and TCP until ctx is
+// cancelled or one of them fails, then stops both and closes the hosts file.
+// It returns the first error, or nil once stopped by ctx. A transport is left
+// out if New was given no connection or listener for it.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	var servers []*dns.Server
+	if s.udpConn != nil {
+		servers = append(servers, s.udpServer())
+	}
+	if s.tcpLn != nil {
+		servers = append(servers, s.tcpServer())
+	}
+	if len(servers) == 0 {
+		return errors.New("neither a UDP connection nor a TCP listener to serve")
+	}
+
+	started := make([]chan struct{}, len(servers))
+	stopped := make([]chan error, len(servers))
+	failed := make(chan struct{}, len(servers))
+	for i, srv := range servers {
+		started[i], stopped[i] = make(chan struct{}), make(chan error, 1)
+		notifyStarted, ready := srv.NotifyStartedFunc, started[i]
+		srv.NotifyStartedFunc = func() {
+			notifyStarted()
+			close(ready)
 		}
-		var req types.Zone
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		go func(srv *dns.Server, stopped chan<- error) {
+			err := srv.ActivateAndServe()
+			stopped <- err
+			failed <- struct{}{}
+		}(srv, stopped[i])
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-failed:
+	}
+	// a server can only be shut down once started, else it must have failed
+	var firstErr error
+	for i, srv := range servers {
+		var err error
+		select {
+		case <-started[i]:
+			_ = srv.Shutdown()
+			err = <-stopped[i]
+		case err = <-stopped[i]:
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.handler.hostsFile != nil {
+		if err := s.handler.hostsFile.Close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
+	}
+	return firstErr
+}
 
-		s.addZone(req)
-		w.WriteHeader(http.StatusOK)
-	})
-	return mux
+func (s *Server) udpServer() *dns.Server {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handler.handleUDP)
+	return &dns.Server{
+		PacketConn: s.udpConn,
+		Handler:    mux,
+		NotifyStartedFunc: func() {
+			s.udpReadyOnce.Do(func() { close(s.udpReady) })
+		},
+	}
 }
 
-func (s *Server) addZone(req types.Zone) {
-	s.handler.zonesLock.Lock()
-	defer s.handler.zonesLock.Unlock()
-	for i, zone := range s.handler.zones {
-		if zone.Name == req.Name {
-			req.Records = append(req.Records, zone.Records...)
-			s.handler.zones[i] = req
-			return
-		}
+func (s *Server) tcpServer() *dns.Server {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handler.handleTCP)
+	ln := s.tcpLn
+	if ln != nil && s.tcpOptions.KeepAlive != 0 {
+		ln = keepAliveListener{Listener: ln, period: s.tcpOptions.KeepAlive}
+	}
+	tcpSrv := &dns.Server{
+		Listener:      ln,
+		Handler:       mux,
+		ReadTimeout:   s.tcpOptions.ReadTimeout,
+		WriteTimeout:  s.tcpOptions.WriteTimeout,
+		MaxTCPQueries: s.tcpOptions.MaxQueries,
+		NotifyStartedFunc: func() {
+			s.tcpReadyOnce.Do(func() { close(s.tcpReady) })
+		},
+	}
+	if idleTimeout := s.tcpOptions.IdleTimeout; idleTimeout != 0 {
+		tcpSrv.IdleTimeout = func() time.Duration { return idleTimeout }
 	}
-	// No existing zone for req.Name, add new one
-	s.handler.zones = append(s.handler.zones, req)
+	return tcpSrv
 }
@@ -0,0 +1,24 @@
+package dns
+
+import "path/filepath"
+
+// SystemConfig is the DNS configuration discovered on the host running the
+// gateway, the first of its servers being the default upstream nameserver.
+type SystemConfig struct {
+	Servers []string `json:"servers"`
+	Port    string   `json:"port"`
+	Search  []string `json:"search"`
+	Ndots   int      `json:"ndots"`
+	// Source is where the configuration was read from
+	Source string `json:"source"`
+}
+
+// resolveSymlinks returns path with its symlinks resolved, or path itself if
+// they can't be.
+func resolveSymlinks(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+
+package dns
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+func defaultHostsFilePath() string {
+	return "/etc/hosts"
+}
+
+// GetSystemConfig returns the DNS configuration read from /etc/resolv.conf.
+func GetSystemConfig() (SystemConfig, error) {
+	return systemConfigFromFile(resolvConfPath)
+}
+
+func systemConfigFromFile(path string) (SystemConfig, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return SystemConfig{}, err
+	}
+	return SystemConfig{
+		Servers: conf.Servers,
+		Port:    conf.Port,
+		Search:  conf.Search,
+		Ndots:   conf.Ndots,
+		Source:  path,
+	}, nil
+}
+
+// watchSystemConfig calls changed whenever /etc/resolv.conf changes, until
+// ctx is done.
+func watchSystemConfig(ctx context.Context, changed func()) error {
+	return watchResolvConf(ctx, resolvConfPath, changed)
+}
+
+// watchResolvConf calls changed whenever the file at path changes, until ctx
+// is done. The file is often replaced by a rename or is a symlink to a file
+// managed by a resolver daemon, so the directories of both are watched.
+func watchResolvConf(ctx context.Context, path string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	watchFiles := func() error {
+		for _, file := range []string{path, resolveSymlinks(path)} {
+			if files[file] {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(file)); err != nil {
+				return err
+			}
+			files[file] = true
+		}
+		return nil
+	}
+	if err := watchFiles(); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !files[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+					continue
+				}
+				// the symlink may point to another file now
+				if err := watchFiles(); err != nil {
+					log.Errorf("error watching %s: %v", path, err)
+				}
+				changed()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("error watching %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build !windows
+
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns system config", func() {
+	ginkgo.It("should parse the nameservers, search domains and ndots of resolv.conf", func() {
+		dir, err := os.MkdirTemp("", "dns-resolv")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "resolv.conf")
+		gomega.Expect(os.WriteFile(path, []byte(`# generated by NetworkManager
+search corp.example.com example.com
+nameserver 192.168.1.1
+nameserver fd00::1
+options ndots:3 timeout:2
+`), 0600)).To(gomega.Succeed())
+
+		conf, err := systemConfigFromFile(path)
+
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(conf).To(gomega.Equal(SystemConfig{
+			Servers: []string{"192.168.1.1", "fd00::1"},
+			Port:    "53",
+			Search:  []string{"corp.example.com", "example.com"},
+			Ndots:   3,
+			Source:  path,
+		}))
+	})
+
+	ginkgo.It("should fail without resolv.conf", func() {
+		_, err := systemConfigFromFile(filepath.Join(os.TempDir(), "missing", "resolv.conf"))
+
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should notice when resolv.conf is replaced", func() {
+		dir, err := os.MkdirTemp("", "dns-resolv")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "resolv.conf")
+		gomega.Expect(os.WriteFile(path, []byte("nameserver 192.168.1.1\n"), 0600)).To(gomega.Succeed())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var changes int32
+
+		gomega.Expect(watchResolvConf(ctx, path, func() { atomic.AddInt32(&changes, 1) })).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(filepath.Join(dir, "other"), []byte("unrelated\n"), 0600)).To(gomega.Succeed())
+		tmp := filepath.Join(dir, "resolv.conf.tmp")
+		gomega.Expect(os.WriteFile(tmp, []byte("nameserver 10.8.0.1\n"), 0600)).To(gomega.Succeed())
+		gomega.Expect(os.Rename(tmp, path)).To(gomega.Succeed())
+
+		gomega.Eventually(func() int32 { return atomic.LoadInt32(&changes) }).Should(gomega.BeNumerically(">", 0))
+	})
+
+	ginkgo.It("should notice when the target of the resolv.conf symlink changes", func() {
+		dir, err := os.MkdirTemp("", "dns-resolv")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer os.RemoveAll(dir)
+		gomega.Expect(os.Mkdir(filepath.Join(dir, "run"), 0700)).To(gomega.Succeed())
+		target := filepath.Join(dir, "run", "stub-resolv.conf")
+		gomega.Expect(os.WriteFile(target, []byte("nameserver 127.0.0.53\n"), 0600)).To(gomega.Succeed())
+		path := filepath.Join(dir, "resolv.conf")
+		gomega.Expect(os.Symlink(target, path)).To(gomega.Succeed())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var changes int32
+
+		gomega.Expect(watchResolvConf(ctx, path, func() { atomic.AddInt32(&changes, 1) })).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(target, []byte("nameserver 10.8.0.1\n"), 0600)).To(gomega.Succeed())
+
+		gomega.Eventually(func() int32 { return atomic.LoadInt32(&changes) }).Should(gomega.BeNumerically(">", 0))
+	})
+})
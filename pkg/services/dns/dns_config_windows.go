@@ -0,0 +1,120 @@
+//go:build windows
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+)
+
+func defaultHostsFilePath() string {
+	return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+}
+
+// GetSystemConfig returns the nameservers and the DNS suffixes of the active
+// network adapters. Windows has no ndots setting, it is always the default
+// of 1.
+func GetSystemConfig() (SystemConfig, error) {
+	servers, suffixes, err := adaptersDNS()
+	if err != nil {
+		return SystemConfig{}, err
+	}
+	return SystemConfig{
+		Servers: servers,
+		Port:    "53",
+		Search:  suffixes,
+		Ndots:   1,
+		Source:  "network adapters",
+	}, nil
+}
+
+func dnsServers() ([]string, error) {
+	servers, _, err := adaptersDNS()
+	return servers, err
+}
+
+// adaptersDNS returns the nameservers and the DNS suffixes, the connection
+// specific ones then the ones of their search lists, of the active network
+// adapters.
+func adaptersDNS() ([]string, []string, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		adapters := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_PREFIX, 0, adapters, &size)
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var servers, suffixes []string
+		seen := map[string]bool{}
+		addSuffix := func(suffix string) {
+			if suffix != "" && !seen[suffix] {
+				seen[suffix] = true
+				suffixes = append(suffixes, suffix)
+			}
+		}
+		for adapter := adapters; adapter != nil; adapter = adapter.Next {
+			if adapter.OperStatus != windows.IfOperStatusUp {
+				continue
+			}
+			for server := adapter.FirstDnsServerAddress; server != nil; server = server.Next {
+				ip := server.Address.IP()
+				// skip the deprecated site-local fec0::/10 resolvers Windows assigns by default
+				if ip == nil || ip.IsLinkLocalUnicast() || (len(ip) == 16 && ip[0] == 0xfe && ip[1]&0xc0 == 0xc0) {
+					continue
+				}
+				servers = append(servers, ip.String())
+			}
+			addSuffix(windows.UTF16PtrToString(adapter.DnsSuffix))
+			for suffix := adapter.FirstDnsSuffix; suffix != nil; suffix = suffix.Next {
+				addSuffix(windows.UTF16ToString(suffix.String[:]))
+			}
+		}
+		return servers, suffixes, nil
+	}
+}
+
+// systemConfigPollInterval is how often the nameservers of the network
+// adapters are checked for changes, Windows not notifying them.
+const systemConfigPollInterval = 5 * time.Second
+
+// watchSystemConfig calls changed whenever the nameservers of the network
+// adapters change, until ctx is done.
+func watchSystemConfig(ctx context.Context, changed func()) error {
+	servers, err := dnsServers()
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(systemConfigPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current, err := dnsServers()
+				if err != nil {
+					log.Errorf("cannot read the nameservers of the network adapters: %v", err)
+					continue
+				}
+				if !equalStrings(current, servers) {
+					servers = current
+					changed()
+				}
+			}
+		}
+	}()
+	return nil
+}
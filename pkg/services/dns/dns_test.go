@@ -1,10 +1,17 @@
 package dns
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
@@ -192,3 +199,1142 @@ var _ = ginkgo.Describe("dns add test", func() {
 		}))
 	})
 })
+
+var _ = ginkgo.Describe("dns local answers", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{
+			{
+				Name:      "internal.",
+				DefaultIP: net.ParseIP("192.168.127.254"),
+				Records: []types.Record{
+					{
+						Name: "corp",
+						MX: []types.MXRecord{
+							{Preference: 10, Exchange: "mail1.internal"},
+							{Preference: 20, Exchange: "mail2.internal."},
+						},
+					},
+					{
+						Name: "_ldap._tcp",
+						SRV: []types.SRVRecord{
+							{Priority: 0, Weight: 5, Port: 389, Target: "ldap.internal"},
+						},
+					},
+					{
+						Name: "web",
+						HTTPS: []types.SVCBRecord{
+							{Priority: 1, ALPN: []string{"h2", "http/1.1"}, Port: 8443, IPv4Hint: []net.IP{net.ParseIP("192.168.127.3")}},
+						},
+					},
+				},
+			},
+		}, WithUpstream(unreachableUpstream))
+	})
+
+	ginkgo.It("should answer MX queries", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("corp.internal.", dns.TypeMX))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		mx := m.Answer[0].(*dns.MX)
+		gomega.Expect(mx.Preference).To(gomega.Equal(uint16(10)))
+		gomega.Expect(mx.Mx).To(gomega.Equal("mail1.internal."))
+		gomega.Expect(m.Answer[1].(*dns.MX).Mx).To(gomega.Equal("mail2.internal."))
+	})
+
+	ginkgo.It("should answer SRV queries", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("_ldap._tcp.internal.", dns.TypeSRV))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.Equal([]dns.RR{&dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   "_ldap._tcp.internal.",
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+			},
+			Priority: 0,
+			Weight:   5,
+			Port:     389,
+			Target:   "ldap.internal.",
+		}}))
+	})
+
+	ginkgo.It("should answer HTTPS queries", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("web.internal.", dns.TypeHTTPS))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		https := m.Answer[0].(*dns.HTTPS)
+		gomega.Expect(https.Hdr.Rrtype).To(gomega.Equal(dns.TypeHTTPS))
+		gomega.Expect(https.Priority).To(gomega.Equal(uint16(1)))
+		gomega.Expect(https.Target).To(gomega.Equal("."))
+		gomega.Expect(https.String()).To(gomega.HaveSuffix(`1 . alpn="h2,http/1.1" port="8443" ipv4hint="192.168.127.3"`))
+
+		// the answer must be packable
+		_, err := m.Pack()
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should answer no data to SVCB queries for a name without such records", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("web.internal.", dns.TypeSVCB))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should answer no data for a name without a record of the requested type", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("corp.internal.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Authoritative).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should answer no data to A queries for a name with only an IPv6 address", func() {
+		upstream := startFakeUpstream("10.0.0.1", 60)
+		defer upstream.stop()
+		server.handler.nameservers = []string{upstream.addr()}
+		gomega.Expect(server.AddZone(types.Zone{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "v6only", IP: net.ParseIP("fd00::2")}},
+		})).To(gomega.Succeed())
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("v6only.internal.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Authoritative).To(gomega.BeTrue())
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should answer the default IP of a zone for unknown names", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("unknown.internal.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.168.127.254"))).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should answer NXDOMAIN for unknown names of a zone without default IP", func() {
+		for _, defaultIP := range []net.IP{nil, {}} {
+			server = newTestServer([]types.Zone{{
+				Name:      "internal.",
+				DefaultIP: defaultIP,
+				Records: []types.Record{{
+					Name: "crc",
+					IP:   net.ParseIP("192.168.127.2"),
+				}},
+			}}, WithUpstream(unreachableUpstream))
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("unknown.internal.", dns.TypeA))
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should answer no data over AAAA for names known locally", func() {
+		for _, name := range []string{"corp.internal.", "unknown.internal."} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeAAAA))
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.RecursionAvailable).To(gomega.BeTrue())
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should answer NXDOMAIN over AAAA for unknown names of a zone without default IP", func() {
+		server = newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{{
+				Name: "crc",
+				IP:   net.ParseIP("192.168.127.2"),
+			}},
+		}}, WithUpstream(unreachableUpstream))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("unknown.internal.", dns.TypeAAAA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(m.RecursionAvailable).To(gomega.BeTrue())
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeAAAA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should answer the TTL of the record, else of the zone, else the default one", func() {
+		server = newTestServer([]types.Zone{
+			{
+				Name: "discovery.",
+				TTL:  5,
+				Records: []types.Record{
+					{Name: "web", IP: net.ParseIP("192.168.127.10")},
+					{Name: "db", IP: net.ParseIP("192.168.127.11"), TTL: 1},
+				},
+			},
+			{
+				Name:      "infra.",
+				TTL:       300,
+				DefaultIP: net.ParseIP("192.168.127.254"),
+				Records: []types.Record{
+					{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+				},
+			},
+			{
+				Name: "internal.",
+				Records: []types.Record{
+					{Name: "crc", IP: net.ParseIP("192.168.127.2")},
+				},
+			},
+		}, WithDefaultTTL(60), WithUpstream(unreachableUpstream))
+
+		for name, ttl := range map[string]uint32{
+			"web.discovery.": 5,
+			"db.discovery.":  1,
+			"gateway.infra.": 300,
+			"unknown.infra.": 300,
+			"crc.internal.":  60,
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(ttl), name)
+		}
+	})
+
+	ginkgo.It("should answer the default IP with the default TTL of its zone", func() {
+		server := newTestServer([]types.Zone{{
+			Name:       "infra.",
+			TTL:        300,
+			DefaultTTL: 10,
+			DefaultIP:  net.ParseIP("192.168.127.254"),
+			Records: []types.Record{
+				{Name: "gateway", IP: net.ParseIP("192.168.127.1")},
+				{Name: "dns", IP: net.ParseIP("192.168.127.53"), TTL: 600},
+			},
+		}}, WithUpstream(unreachableUpstream))
+
+		for name, ttl := range map[string]uint32{
+			"unknown.infra.": 10,
+			"infra.":         10,
+			"gateway.infra.": 300,
+			"dns.infra.":     600,
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(ttl), name)
+		}
+	})
+
+	ginkgo.It("should answer the default IP of a zone at its apex", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.168.127.254"))).To(gomega.BeTrue())
+
+		for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeMX} {
+			m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", qtype))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should answer an IPv6 default IP over AAAA", func() {
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("fd00::254"),
+		}}, WithUpstream(unreachableUpstream))
+
+		for _, name := range []string{"internal.", "unknown.internal."} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeAAAA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::254"))).To(gomega.BeTrue())
+
+			m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should answer the IPv6 addresses of the records over AAAA", func() {
+		server = newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "dual", IP: net.ParseIP("192.168.127.2"), IPv6: net.ParseIP("fd00::2")},
+				{Name: "v6only", IP: net.ParseIP("fd00::3")},
+				{Name: "v4only", IP: net.ParseIP("192.168.127.4")},
+				{Glob: "*-dev", IPv6: net.ParseIP("fd00::5")},
+			},
+		}}, WithUpstream(unreachableUpstream))
+
+		for name, ip := range map[string]string{
+			"dual.internal.":    "fd00::2",
+			"v6only.internal.":  "fd00::3",
+			"web-dev.internal.": "fd00::5",
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeAAAA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal(ip), name)
+		}
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("dual.internal.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+
+		// only an IPv4 address is no data over AAAA
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("v4only.internal.", dns.TypeAAAA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should answer the IPv6 addresses of the views over AAAA", func() {
+		server = newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{{
+				Name:  "crc",
+				IP:    net.ParseIP("192.168.127.2"),
+				IPv6:  net.ParseIP("fd00::2"),
+				Views: []types.View{{Subnet: "10.0.0.0/8", IP: net.ParseIP("fd00::10")}},
+			}},
+		}}, WithUpstream(unreachableUpstream))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, net.ParseIP("10.0.0.1"), query("crc.internal.", dns.TypeAAAA))
+		gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal("fd00::10"))
+		// the view has no IPv4 address
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, net.ParseIP("10.0.0.1"), query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+	})
+
+	ginkgo.It("should answer the default IP of the requested family", func() {
+		server = newTestServer([]types.Zone{{
+			Name:        "internal.",
+			DefaultIP:   net.ParseIP("192.168.127.254"),
+			DefaultIPv6: net.ParseIP("fd00::254"),
+			Records:     []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithUpstream(unreachableUpstream))
+
+		for _, name := range []string{"internal.", "unknown.internal."} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.168.127.254"))).To(gomega.BeTrue())
+
+			m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeAAAA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::254"))).To(gomega.BeTrue())
+		}
+
+		// the records keep answering no data over AAAA
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeAAAA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should answer no data at the apex of a zone without default IP", func() {
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithUpstream(unreachableUpstream))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should answer the view matching the client address", func() {
+		server = newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{{
+				Name: "web",
+				IP:   net.ParseIP("203.0.113.10"),
+				Views: []types.View{{
+					Subnet: "192.168.127.0/24",
+					IP:     net.ParseIP("192.168.127.10"),
+				}},
+			}},
+		}}, WithUpstream(unreachableUpstream))
+
+		for client, expected := range map[string]string{
+			"192.168.127.2": "192.168.127.10",
+			"10.0.0.2":      "203.0.113.10",
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, net.ParseIP(client), query("web.internal.", dns.TypeA))
+
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(expected))
+		}
+	})
+})
+
+var _ = ginkgo.Describe("dns query classes", func() {
+	ginkgo.It("should refuse the queries of other classes than IN for the names of the local zones", func() {
+		exchanger := &mockExchanger{respond: answerA("10.0.0.1", 60)}
+		server := newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+			Records:   []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+
+		for _, class := range []uint16{dns.ClassHESIOD, dns.ClassANY, dns.ClassCHAOS} {
+			for _, name := range []string{"crc.internal.", "unknown.internal."} {
+				r := query(name, dns.TypeA)
+				r.Question[0].Qclass = class
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+
+				gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused), name)
+				gomega.Expect(m.Answer).To(gomega.BeEmpty(), name)
+			}
+		}
+		gomega.Expect(exchanger.queryCount()).To(gomega.BeZero())
+	})
+})
+
+var _ = ginkgo.Describe("dns malformed queries", func() {
+	var (
+		server   *Server
+		upstream *fakeUpstream
+	)
+
+	ginkgo.BeforeEach(func() {
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()))
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+	})
+
+	for description, name := range map[string]string{
+		"an empty name":    "",
+		"a label too long": strings.Repeat("a", 64) + ".example.com.",
+		"a name too long":  strings.Repeat(strings.Repeat("a", 63)+".", 5),
+		"an empty label":   "foo..example.com.",
+	} {
+		name := name
+		ginkgo.It("should answer FORMERR to a query with "+description, func() {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeFormatError))
+			gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+		})
+	}
+
+	ginkgo.It("should answer FORMERR to a message without a question", func() {
+		r := new(dns.Msg)
+		r.Id = dns.Id()
+		r.RecursionDesired = true
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeFormatError))
+		gomega.Expect(m.Id).To(gomega.Equal(r.Id))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should refuse the NS query of the root without forwarding it", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(".", dns.TypeNS))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should answer the NS query of the root with the root hints", func() {
+		WithRootHints("a.root-servers.net", "b.root-servers.net.")(server)
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(".", dns.TypeNS))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.NS).Ns).To(gomega.Equal("a.root-servers.net."))
+		gomega.Expect(m.Answer[1].(*dns.NS).Ns).To(gomega.Equal("b.root-servers.net."))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+})
+
+var _ = ginkgo.Describe("dns zone apex", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+			TTL:       300,
+			SOA: &types.SOARecord{
+				Ns:      "ns1.internal",
+				Mbox:    "hostmaster.internal.",
+				Serial:  2024010101,
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				Minttl:  60,
+			},
+			NS: []string{"ns1.internal", "ns2.internal."},
+		}}, WithoutForwarding())
+	})
+
+	ginkgo.It("should answer SOA queries at the apex", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", dns.TypeSOA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Authoritative).To(gomega.BeTrue())
+		gomega.Expect(m.Answer).To(gomega.Equal([]dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "internal.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			Ns:      "ns1.internal.",
+			Mbox:    "hostmaster.internal.",
+			Serial:  2024010101,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}}))
+	})
+
+	ginkgo.It("should answer NS queries at the apex", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", dns.TypeNS))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Authoritative).To(gomega.BeTrue())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.NS).Ns).To(gomega.Equal("ns1.internal."))
+		gomega.Expect(m.Answer[1].(*dns.NS).Ns).To(gomega.Equal("ns2.internal."))
+	})
+
+	ginkgo.It("should answer no data to SOA and NS queries below the apex", func() {
+		for _, qtype := range []uint16{dns.TypeSOA, dns.TypeNS} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", qtype))
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should answer the default IP at the apex", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("internal.", dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+})
+
+var _ = ginkgo.Describe("dns record names", func() {
+	ginkgo.It("should resolve records named as labels, with the zone suffix, or fully qualified", func() {
+		zone := types.Zone{
+			Name: "internal",
+			Records: []types.Record{
+				{Name: "web", IP: net.ParseIP("192.168.127.2")},
+				{Name: "api.internal", IP: net.ParseIP("192.168.127.3")},
+				{Name: "db.internal.", IP: net.ParseIP("192.168.127.4")},
+				{Name: "cache.", IP: net.ParseIP("192.168.127.5")},
+			},
+		}
+		server := newTestServer([]types.Zone{zone}, WithoutForwarding())
+		added := newTestServer(nil, WithoutForwarding())
+		gomega.Expect(added.AddZone(zone)).To(gomega.Succeed())
+
+		for _, server := range []*Server{server, added} {
+			for name, ip := range map[string]string{
+				"web.internal.":   "192.168.127.2",
+				"api.internal.":   "192.168.127.3",
+				"db.internal.":    "192.168.127.4",
+				"cache.internal.": "192.168.127.5",
+			} {
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+				gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+				gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(ip), name)
+			}
+		}
+		// the zone given by the caller is left untouched
+		gomega.Expect(zone.Records[1].Name).To(gomega.Equal("api.internal"))
+	})
+})
+
+var _ = ginkgo.Describe("dns glob records", func() {
+	answer := func(server *Server, name string) *dns.Msg {
+		return server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+	}
+
+	ginkgo.It("should answer the names matching a glob", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Glob: "*-dev", IP: net.ParseIP("192.168.127.10")},
+			},
+		}}, WithoutForwarding())
+
+		for _, name := range []string{"web-dev.internal.", "api.web-dev.internal."} {
+			m := answer(server, name)
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.10"), name)
+		}
+	})
+
+	ginkgo.It("should not answer the names not matching a glob", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Glob: "web-?", IP: net.ParseIP("192.168.127.10")},
+			},
+		}}, WithoutForwarding())
+
+		for _, name := range []string{"web-10.internal.", "dev-web-1.internal.", "web.internal."} {
+			m := answer(server, name)
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError), name)
+			gomega.Expect(m.Answer).To(gomega.BeEmpty(), name)
+		}
+		gomega.Expect(answer(server, "web-1.internal.").Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should prefer the exact records to the glob ones", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "web-dev", IP: net.ParseIP("192.168.127.2")},
+				{Glob: "*-dev", IP: net.ParseIP("192.168.127.10")},
+				{Name: "api-dev", IP: net.ParseIP("192.168.127.3")},
+			},
+		}}, WithoutForwarding())
+
+		for name, ip := range map[string]string{
+			"web-dev.internal.": "192.168.127.2",
+			"db-dev.internal.":  "192.168.127.10",
+			"api-dev.internal.": "192.168.127.3",
+		} {
+			m := answer(server, name)
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(ip), name)
+		}
+	})
+})
+
+var _ = ginkgo.Describe("dns record precedence", func() {
+	ginkgo.It("should prefer the exact records to the regexps, and the regexps to the default IP", func() {
+		server := newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.1"),
+			Records: []types.Record{
+				{Regexp: regexp.MustCompile("^web"), IP: net.ParseIP("192.168.127.10")},
+				{Name: "web", IP: net.ParseIP("192.168.127.2")},
+			},
+		}}, WithoutForwarding())
+
+		for name, ip := range map[string]string{
+			"web.internal.":     "192.168.127.2",
+			"web-dev.internal.": "192.168.127.10",
+			"api.internal.":     "192.168.127.1",
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(ip), name)
+		}
+	})
+
+	ginkgo.It("should not fall back to the regexps for the types missing the exact record", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Regexp: regexp.MustCompile(".*"), IP: net.ParseIP("192.168.127.10")},
+				{Name: "mail", MX: []types.MXRecord{{Preference: 10, Exchange: "mx.internal."}}},
+			},
+		}}, WithoutForwarding())
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("mail.internal.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+})
+
+var _ = ginkgo.Describe("dns weighted records", func() {
+	ginkgo.It("should spread answers according to the weights", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "web", IP: net.ParseIP("192.168.127.10"), Weight: 80},
+				{Name: "web", IP: net.ParseIP("192.168.127.20"), Weight: 20},
+			},
+		}}, WithRandomSeed(42), WithUpstream(unreachableUpstream))
+
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("web.internal.", dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			counts[m.Answer[0].(*dns.A).A.String()]++
+		}
+
+		gomega.Expect(counts["192.168.127.10"]).To(gomega.BeNumerically("~", 8000, 300))
+		gomega.Expect(counts["192.168.127.20"]).To(gomega.BeNumerically("~", 2000, 300))
+	})
+
+	ginkgo.It("should answer the first record when there are no weights", func() {
+		server := newTestServer([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "web", IP: net.ParseIP("192.168.127.10")},
+				{Name: "web", IP: net.ParseIP("192.168.127.20")},
+			},
+		}}, WithUpstream(unreachableUpstream))
+
+		for i := 0; i < 10; i++ {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("web.internal.", dns.TypeA))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.10"))
+		}
+	})
+})
+
+var _ = ginkgo.Describe("dns delegations", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+			Records: []types.Record{{
+				Name: "lab",
+				NS: []types.NSRecord{
+					{Host: "ns1.lab.internal", IP: net.ParseIP("192.168.127.53")},
+					{Host: "ns.example.com."},
+				},
+			}},
+		}}, WithUpstream(unreachableUpstream))
+	})
+
+	ginkgo.It("should answer NS queries for a delegated subdomain with glue", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("lab.internal.", dns.TypeNS))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.NS).Ns).To(gomega.Equal("ns1.lab.internal."))
+		gomega.Expect(m.Answer[1].(*dns.NS).Ns).To(gomega.Equal("ns.example.com."))
+		gomega.Expect(m.Extra).To(gomega.HaveLen(1))
+		gomega.Expect(m.Extra[0].Header().Name).To(gomega.Equal("ns1.lab.internal."))
+		gomega.Expect(m.Extra[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.53"))
+	})
+
+	ginkgo.It("should refer queries under a delegated subdomain", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("host.lab.internal.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(m.Ns).To(gomega.HaveLen(2))
+		gomega.Expect(m.Ns[0].Header().Name).To(gomega.Equal("lab.internal."))
+		gomega.Expect(m.Extra).To(gomega.HaveLen(1))
+	})
+})
+
+var _ = ginkgo.Describe("dns CNAME and TXT records", func() {
+	var (
+		server   *Server
+		upstream *fakeUpstream
+	)
+
+	ginkgo.BeforeEach(func() {
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		var err error
+		server, err = New(nil, nil, []types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "crc", IP: net.ParseIP("192.168.127.2"), TXT: []string{"owner=infra", strings.Repeat("x", 300)}},
+				{Name: "www", CNAME: "crc.internal"},
+				{Name: "api", CNAME: "www.internal."},
+				{Name: "docs", CNAME: "docs.example.com."},
+				{Name: "missing", CNAME: "nowhere.internal."},
+				{Name: "loop1", CNAME: "loop2.internal."},
+				{Name: "loop2", CNAME: "loop1.internal."},
+			},
+		}}, WithUpstream(upstream.addr()))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+	})
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		return server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, qtype))
+	}
+
+	ginkgo.It("should follow the aliases to their targets in the local zones", func() {
+		m := ask("api.internal.", dns.TypeA)
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(3))
+		gomega.Expect(m.Answer[0].(*dns.CNAME).Target).To(gomega.Equal("www.internal."))
+		gomega.Expect(m.Answer[1].(*dns.CNAME).Target).To(gomega.Equal("crc.internal."))
+		gomega.Expect(m.Answer[2].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should only answer the alias to CNAME queries", func() {
+		m := ask("api.internal.", dns.TypeCNAME)
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.CNAME).Target).To(gomega.Equal("www.internal."))
+	})
+
+	ginkgo.It("should answer NXDOMAIN along with an alias to a missing local name", func() {
+		m := ask("missing.internal.", dns.TypeA)
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should stop following a loop of aliases", func() {
+		m := ask("loop1.internal.", dns.TypeA)
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should forward the query for a target out of the local zones", func() {
+		m := ask("docs.internal.", dns.TypeA)
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.CNAME).Target).To(gomega.Equal("docs.example.com."))
+		gomega.Expect(m.Answer[1].Header().Name).To(gomega.Equal("docs.example.com."))
+		gomega.Expect(m.Answer[1].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		gomega.Expect(m.Question[0].Name).To(gomega.Equal("docs.internal."))
+	})
+
+	ginkgo.It("should leave a target out of the local zones to the client when not forwarding", func() {
+		WithoutForwarding()(server)
+
+		m := ask("docs.internal.", dns.TypeA)
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should answer the texts of a record, split in strings of 255 bytes", func() {
+		m := ask("crc.internal.", dns.TypeTXT)
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.TXT).Txt).To(gomega.Equal([]string{"owner=infra"}))
+		gomega.Expect(m.Answer[1].(*dns.TXT).Txt).To(gomega.Equal([]string{strings.Repeat("x", 255), strings.Repeat("x", 45)}))
+		_, err := m.Pack()
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should reject an alias with other data", func() {
+		err := server.AddZone(types.Zone{Name: "internal.", Records: []types.Record{{Name: "web", CNAME: "crc.internal.", IP: net.ParseIP("192.168.127.3")}}})
+
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("excludes any other data")))
+	})
+})
+
+var _ = ginkgo.Describe("dns TCP server", func() {
+	var closers []io.Closer
+
+	ginkgo.AfterEach(func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		closers = nil
+	})
+
+	serve := func(tcpOptions TCPOptions) net.Addr {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		closers = append(closers, ln)
+		server, err := New(nil, ln, []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithTCPOptions(tcpOptions), WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		go func() {
+			_ = server.ServeTCP()
+		}()
+		<-server.ReadyTCP()
+		return ln.Addr()
+	}
+
+	dial := func(addr net.Addr) *dns.Conn {
+		conn, err := dns.Dial("tcp", addr.String())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		closers = append(closers, conn)
+		return conn
+	}
+
+	exchange := func(conn *dns.Conn) error {
+		client := &dns.Client{Net: "tcp", Timeout: time.Second}
+		_, _, err := client.ExchangeWithConn(query("crc.internal.", dns.TypeA), conn)
+		return err
+	}
+
+	ginkgo.It("should answer several queries on the same connection within the idle timeout", func() {
+		conn := dial(serve(TCPOptions{IdleTimeout: 2 * time.Second}))
+
+		for i := 0; i < 3; i++ {
+			gomega.Expect(exchange(conn)).To(gomega.Succeed())
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	ginkgo.It("should close a connection idle for longer than the idle timeout", func() {
+		conn := dial(serve(TCPOptions{IdleTimeout: 200 * time.Millisecond}))
+
+		gomega.Expect(exchange(conn)).To(gomega.Succeed())
+		time.Sleep(500 * time.Millisecond)
+		gomega.Expect(exchange(conn)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should close the connection after the maximum number of queries", func() {
+		conn := dial(serve(TCPOptions{MaxQueries: 1}))
+
+		gomega.Expect(exchange(conn)).To(gomega.Succeed())
+		gomega.Expect(exchange(conn)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should tell the idle timeout to the clients asking with edns-tcp-keepalive", func() {
+		conn := dial(serve(TCPOptions{IdleTimeout: 2 * time.Second}))
+		client := &dns.Client{Net: "tcp", Timeout: time.Second}
+
+		m, _, err := client.ExchangeWithConn(edns0Query("crc.internal.", dns.TypeA), conn)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(hasEDNS0Option(m.IsEdns0(), dns.EDNS0TCPKEEPALIVE)).To(gomega.BeFalse())
+
+		r := edns0Query("crc.internal.", dns.TypeA)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		m, _, err = client.ExchangeWithConn(r, conn)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(m.IsEdns0().Option).To(gomega.HaveLen(1))
+		keepalive, ok := m.IsEdns0().Option[0].(*dns.EDNS0_TCP_KEEPALIVE)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(keepalive.Timeout).To(gomega.Equal(uint16(20)))
+	})
+
+	ginkgo.It("should set the keepalive probes of the accepted connections", func() {
+		for _, period := range []time.Duration{time.Minute, -1} {
+			conn := &fakeKeepAliveConn{}
+			ln := keepAliveListener{Listener: &fakeListener{conn: conn}, period: period}
+
+			_, err := ln.Accept()
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			gomega.Expect(conn.keepAlive).To(gomega.Equal(period > 0))
+			if period > 0 {
+				gomega.Expect(conn.period).To(gomega.Equal(period))
+			}
+		}
+	})
+})
+
+// fakeListener accepts conn.
+type fakeListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+// fakeKeepAliveConn records its keepalive settings.
+type fakeKeepAliveConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *fakeKeepAliveConn) SetKeepAlive(keepAlive bool) error {
+	c.keepAlive = keepAlive
+	return nil
+}
+
+func (c *fakeKeepAliveConn) SetKeepAlivePeriod(period time.Duration) error {
+	c.period = period
+	return nil
+}
+
+var _ = ginkgo.Describe("dns large answers", func() {
+	var (
+		server  *Server
+		udpConn net.PacketConn
+		tcpLn   net.Listener
+	)
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		udpConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		tcpLn, err = net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		record := types.Record{Name: "big"}
+		for i := 0; i < 60; i++ {
+			record.SRV = append(record.SRV, types.SRVRecord{Priority: 10, Weight: 10, Port: 8080, Target: fmt.Sprintf("backend-%02d.internal.", i)})
+		}
+		server, err = New(udpConn, tcpLn, []types.Zone{{Name: "internal.", Records: []types.Record{record}}}, WithoutForwarding())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		go func() {
+			_ = server.Serve()
+		}()
+		go func() {
+			_ = server.ServeTCP()
+		}()
+		<-server.Ready()
+		<-server.ReadyTCP()
+	})
+
+	ginkgo.AfterEach(func() {
+		udpConn.Close()
+		tcpLn.Close()
+	})
+
+	exchange := func(network string, addr net.Addr) *dns.Msg {
+		client := &dns.Client{Net: network, Timeout: time.Second}
+		r := edns0Query("big.internal.", dns.TypeSRV)
+		r.IsEdns0().SetUDPSize(1232)
+		m, _, err := client.Exchange(r, addr.String())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		return m
+	}
+
+	ginkgo.It("should set the TC bit when the answer doesn't fit over UDP, and answer it whole over TCP", func() {
+		m := exchange("udp", udpConn.LocalAddr())
+		gomega.Expect(m.Truncated).To(gomega.BeTrue())
+		gomega.Expect(len(m.Answer)).To(gomega.BeNumerically("<", 60))
+		// the records only fit compressed
+		m.Compress = true
+		gomega.Expect(m.Len()).To(gomega.BeNumerically("<=", 1232))
+
+		m = exchange("tcp", tcpLn.Addr())
+		gomega.Expect(m.Truncated).To(gomega.BeFalse())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(60))
+	})
+})
+
+var _ = ginkgo.Describe("dns server readiness", func() {
+	ginkgo.It("should answer as soon as it is ready", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer conn.Close()
+		server, err := New(conn, nil, []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		gomega.Consistently(server.Ready(), "100ms").ShouldNot(gomega.BeClosed())
+		go func() {
+			_ = server.Serve()
+		}()
+		gomega.Eventually(server.Ready(), "1s").Should(gomega.BeClosed())
+
+		client := &dns.Client{Net: "udp", Timeout: time.Second}
+		m, _, err := client.Exchange(query("crc.internal.", dns.TypeA), conn.LocalAddr().String())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+})
+
+var _ = ginkgo.Describe("dns ListenAndServe", func() {
+	ginkgo.It("should stop both transports when the context is cancelled", func() {
+		udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer udpConn.Close()
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		server, err := New(udpConn, tcpLn, []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- server.ListenAndServe(ctx)
+		}()
+		<-server.Ready()
+		<-server.ReadyTCP()
+		for _, network := range []string{"udp", "tcp"} {
+			addr := udpConn.LocalAddr().String()
+			if network == "tcp" {
+				addr = tcpLn.Addr().String()
+			}
+			client := &dns.Client{Net: network, Timeout: time.Second}
+			_, _, err := client.Exchange(query("crc.internal.", dns.TypeA), addr)
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred(), network)
+		}
+
+		cancel()
+		gomega.Eventually(done, 5*time.Second).Should(gomega.Receive(gomega.BeNil()))
+		_, err = net.DialTimeout("tcp", tcpLn.Addr().String(), time.Second)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		client := &dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+		_, _, err = client.Exchange(query("crc.internal.", dns.TypeA), udpConn.LocalAddr().String())
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should stop the other transport when one fails", func() {
+		udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer udpConn.Close()
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		tcpLn.Close()
+		server, err := New(udpConn, tcpLn, []types.Zone{}, WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- server.ListenAndServe(context.Background())
+		}()
+
+		gomega.Eventually(done, 5*time.Second).Should(gomega.Receive(gomega.HaveOccurred()))
+	})
+
+	ginkgo.It("should serve only the transports given to New", func() {
+		server, err := New(nil, nil, []types.Zone{}, WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		gomega.Expect(server.ListenAndServe(context.Background())).ToNot(gomega.Succeed())
+	})
+})
+
+var _ = ginkgo.Describe("dns reverse lookups", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{
+			{
+				Name:      "containers.internal.",
+				DefaultIP: net.ParseIP("192.168.127.254"),
+				TTL:       30,
+				Records: []types.Record{
+					{Name: "gateway", IP: net.ParseIP("192.168.127.1"), IPv6: net.ParseIP("fd00::1")},
+					{Name: "host", IP: net.ParseIP("192.168.127.254")},
+					{Glob: "vm-*", IP: net.ParseIP("192.168.127.3")},
+				},
+			},
+			{
+				Name:    "testing.",
+				Records: []types.Record{{Name: "gateway", IP: net.ParseIP("192.168.127.1"), TTL: 60}},
+			},
+		}, WithoutForwarding())
+	})
+
+	ginkgo.It("should answer the names of the records with an address", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("1.127.168.192.in-addr.arpa.", dns.TypePTR))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("gateway.containers.internal."))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(30)))
+		gomega.Expect(m.Answer[1].(*dns.PTR).Ptr).To(gomega.Equal("gateway.testing."))
+		gomega.Expect(m.Answer[1].Header().Ttl).To(gomega.Equal(uint32(60)))
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("gateway.containers.internal."))
+	})
+
+	ginkgo.It("should not answer the addresses of globs and of the default IPs only", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("3.127.168.192.in-addr.arpa.", dns.TypePTR))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("254.127.168.192.in-addr.arpa.", dns.TypePTR))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal("host.containers.internal."))
+	})
+})
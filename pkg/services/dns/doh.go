@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohClient is an Exchanger sending the queries to a DNS over HTTPS
+// endpoint (RFC 8484), the address of the nameserver being its URL.
+type dohClient struct {
+	httpClient *http.Client
+}
+
+func newDoHClient(httpClient *http.Client) *dohClient {
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				// the proxy of the host, if any
+				Proxy:             http.ProxyFromEnvironment,
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+				IdleConnTimeout:   idleConnTimeout,
+			},
+		}
+	}
+	return &dohClient{httpClient: httpClient}
+}
+
+func (c *dohClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	// the ID is 0 so that the HTTP caches see identical queries (RFC 8484, section 4.1)
+	query := m.Copy()
+	query.Id = 0
+	body, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH endpoint answered %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dohMediaType {
+		return nil, 0, fmt.Errorf("DoH endpoint answered %q content", contentType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil {
+		return nil, 0, err
+	}
+	r.Id = m.Id
+	return r, time.Since(start), nil
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns over HTTPS upstream", func() {
+	var (
+		endpoint *httptest.Server
+		queries  int32
+		status   int
+	)
+
+	ginkgo.BeforeEach(func() {
+		atomic.StoreInt32(&queries, 0)
+		status = http.StatusOK
+		endpoint = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&queries, 1)
+			gomega.Expect(r.Method).To(gomega.Equal(http.MethodPost))
+			gomega.Expect(r.Header.Get("Content-Type")).To(gomega.Equal("application/dns-message"))
+			body, err := io.ReadAll(r.Body)
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			req := new(dns.Msg)
+			gomega.Expect(req.Unpack(body)).To(gomega.Succeed())
+			gomega.Expect(req.Id).To(gomega.BeZero())
+
+			resp, _ := answerA("10.0.0.1", 60)(req)
+			data, err := resp.Pack()
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.WriteHeader(status)
+			_, _ = w.Write(data)
+		}))
+	})
+
+	ginkgo.AfterEach(func() {
+		endpoint.Close()
+	})
+
+	newServer := func() *Server {
+		server, err := New(nil, nil, []types.Zone{}, WithHTTPSUpstream(endpoint.URL+"/dns-query", endpoint.Client()))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		return server
+	}
+
+	ginkgo.It("should resolve the names through the DoH endpoint", func() {
+		server := newServer()
+
+		for _, dnsClient := range []Exchanger{server.handler.udpClient, server.handler.tcpClient} {
+			r := query("example.com.", dns.TypeA)
+			m := server.handler.addAnswers(context.Background(), dnsClient, nil, r)
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Id).To(gomega.Equal(r.Id))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+			server.FlushCache("")
+		}
+		gomega.Expect(atomic.LoadInt32(&queries)).To(gomega.Equal(int32(2)))
+		gomega.Expect(server.handler.upstream()).To(gomega.Equal(endpoint.URL + "/dns-query"))
+	})
+
+	ginkgo.It("should answer SERVFAIL when the DoH endpoint fails", func() {
+		status = http.StatusBadGateway
+		server := newServer()
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+	})
+
+	ginkgo.It("should use the proxy of the host by default", func() {
+		dohClient := newDoHClient(nil)
+
+		gomega.Expect(dohClient.httpClient.Transport.(*http.Transport).Proxy).NotTo(gomega.BeNil())
+	})
+})
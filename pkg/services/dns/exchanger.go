@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends a query to the nameserver at address and returns its reply.
+// It must give up once ctx is done. *dns.Client only stops at the deadline of
+// ctx, the default implementation also stops when ctx is cancelled.
+type Exchanger interface {
+	ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// client is the default Exchanger, a dns.Client interrupted when ctx is cancelled.
+type client struct {
+	*dns.Client
+}
+
+func (c client) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	conn, err := c.DialContext(ctx, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	return c.exchange(ctx, m, conn)
+}
+
+// exchange sends m on conn, giving up as soon as ctx is done.
+func (c client) exchange(ctx context.Context, m *dns.Msg, conn *dns.Conn) (*dns.Msg, time.Duration, error) {
+	// miekg/dns only uses the deadline of ctx, unblock the exchange on cancellation as well
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	// once returned, conn is left alone and can be reused
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return c.ExchangeWithConnContext(ctx, m, conn)
+}
+
+// plainClient is an Exchanger sending the queries over UDP, and again over
+// TCP when the response is truncated, as a stub resolver does.
+type plainClient struct {
+	udp Exchanger
+	tcp Exchanger
+}
+
+func (c plainClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	resp, rtt, err := c.udp.ExchangeContext(ctx, m, address)
+	if err != nil || !resp.Truncated {
+		return resp, rtt, err
+	}
+	return c.tcp.ExchangeContext(ctx, m, address)
+}
+
+const (
+	// maxIdleConns bounds the connections kept open to each upstream nameserver
+	maxIdleConns = 4
+	// idleConnTimeout is how long an unused connection is kept open
+	idleConnTimeout = 30 * time.Second
+)
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// pooledClient is an Exchanger reusing its connections to the upstream
+// nameservers (RFC 7766), to avoid a TCP handshake for each query.
+type pooledClient struct {
+	client
+
+	lock sync.Mutex
+	idle map[string][]idleConn
+	now  func() time.Time
+}
+
+func newPooledClient(dnsClient *dns.Client) *pooledClient {
+	return &pooledClient{
+		client: client{dnsClient},
+		idle:   make(map[string][]idleConn),
+		now:    time.Now,
+	}
+}
+
+func (c *pooledClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if conn := c.get(address); conn != nil {
+		resp, rtt, err := c.exchange(ctx, m, conn)
+		if err == nil {
+			c.release(ctx, address, conn)
+			return resp, rtt, nil
+		}
+		conn.Close()
+		// the upstream may have closed the idle connection, retry on a new one
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+	}
+	conn, err := c.DialContext(ctx, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, rtt, err := c.exchange(ctx, m, conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	c.release(ctx, address, conn)
+	return resp, rtt, nil
+}
+
+// release keeps conn open for the next queries, unless its deadline was
+// changed by the cancellation of ctx.
+func (c *pooledClient) release(ctx context.Context, address string, conn *dns.Conn) {
+	if ctx.Err() != nil {
+		conn.Close()
+		return
+	}
+	c.put(address, conn)
+}
+
+// get returns the most recently used connection to address, closing the
+// ones idle for too long, or nil if there is none.
+func (c *pooledClient) get(address string) *dns.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conns := c.idle[address]
+	for len(conns) > 0 {
+		last := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if c.now().Sub(last.since) < idleConnTimeout {
+			c.idle[address] = conns
+			return last.conn
+		}
+		last.conn.Close()
+	}
+	delete(c.idle, address)
+	return nil
+}
+
+// put keeps conn open for the next queries to address, unless there are
+// enough idle connections already.
+func (c *pooledClient) put(address string, conn *dns.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.idle[address]) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle[address] = append(c.idle[address], idleConn{conn: conn, since: c.now()})
+}
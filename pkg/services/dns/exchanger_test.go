@@ -0,0 +1,371 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// mockExchanger answers the queries with the result of respond, without any network.
+type mockExchanger struct {
+	lock      sync.Mutex
+	addresses []string
+	respond   func(m *dns.Msg) (*dns.Msg, error)
+}
+
+func (e *mockExchanger) ExchangeContext(_ context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.lock.Lock()
+	e.addresses = append(e.addresses, address)
+	e.lock.Unlock()
+	resp, err := e.respond(m)
+	return resp, 0, err
+}
+
+func (e *mockExchanger) queryCount() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.addresses)
+}
+
+func answerA(address string, ttl uint32) func(m *dns.Msg) (*dns.Msg, error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   m.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: net.ParseIP(address),
+		})
+		return resp, nil
+	}
+}
+
+var _ = ginkgo.Describe("dns exchanger", func() {
+	var (
+		server    *Server
+		exchanger *mockExchanger
+	)
+
+	ginkgo.BeforeEach(func() {
+		exchanger = &mockExchanger{respond: answerA("10.0.0.1", 60)}
+		var err error
+		server, err = New(nil, nil, []types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should forward through the exchanger", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		gomega.Expect(exchanger.addresses).To(gomega.Equal([]string{"192.168.1.1:53"}))
+	})
+
+	ginkgo.It("should use the exchanger for TCP queries too", func() {
+		server.handler.addAnswers(context.Background(), server.handler.tcpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should cache the answers of the exchanger", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should not cache the errors of the exchanger", func() {
+		exchanger.respond = func(*dns.Msg) (*dns.Msg, error) {
+			return nil, errors.New("connection refused")
+		}
+		for i := 0; i < 2; i++ {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+			gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		}
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(2))
+	})
+})
+
+var _ = ginkgo.Describe("dns response headers", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		// the upstream answers with another ID and the question in lower case
+		exchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			if strings.HasPrefix(strings.ToLower(m.Question[0].Name), "unreachable") {
+				return nil, errors.New("connection refused")
+			}
+			resp, _ := answerA("10.0.0.1", 60)(m)
+			resp.Id = m.Id + 1
+			resp.Question[0].Name = strings.ToLower(m.Question[0].Name)
+			return resp, nil
+		}}
+		var err error
+		server, err = New(nil, nil, []types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "crc", IP: net.ParseIP("192.168.127.2")},
+			},
+			DefaultIPv6: net.ParseIP("fd00::2"),
+		}}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	for description, r := range map[string]*dns.Msg{
+		"local answers":          query("crc.internal.", dns.TypeA),
+		"local AAAA answers":     query("crc.internal.", dns.TypeAAAA),
+		"forwarded answers":      query("Example.COM.", dns.TypeA),
+		"forwarded AAAA answers": query("Example.COM.", dns.TypeAAAA),
+		"forwarding errors":      query("unreachable.example.com.", dns.TypeA),
+	} {
+		r := r
+		ginkgo.It("should give the ID and the question of the query to the "+description, func() {
+			r.CheckingDisabled = true
+			for i := 0; i < 2; i++ {
+				r.Id = dns.Id()
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+
+				gomega.Expect(m.Id).To(gomega.Equal(r.Id))
+				gomega.Expect(m.Question).To(gomega.Equal(r.Question))
+				gomega.Expect(m.RecursionDesired).To(gomega.BeTrue())
+				gomega.Expect(m.CheckingDisabled).To(gomega.BeTrue())
+				gomega.Expect(m.Response).To(gomega.BeTrue())
+			}
+		})
+	}
+
+	ginkgo.It("should give the question of the query to the cached answers", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		r := query("EXAMPLE.com.", dns.TypeA)
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+
+		gomega.Expect(m.Id).To(gomega.Equal(r.Id))
+		gomega.Expect(m.Question).To(gomega.Equal(r.Question))
+	})
+})
+
+var _ = ginkgo.Describe("dns upstream concurrency", func() {
+	var (
+		inFlight    int32
+		maxInFlight int32
+		release     chan struct{}
+		exchanger   *mockExchanger
+	)
+
+	ginkgo.BeforeEach(func() {
+		inFlight, maxInFlight = 0, 0
+		release = make(chan struct{})
+		exchanger = &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			<-release
+			return answerA("10.0.0.1", 60)(m)
+		}}
+	})
+
+	ginkgo.It("should never exceed the maximum of queries in flight", func() {
+		server, err := New(nil, nil, []types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithMaxUpstreamQueries(2, true))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		var wg sync.WaitGroup
+		rcodes := make(chan int, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(fmt.Sprintf("host%d.example.com.", i), dns.TypeA))
+				rcodes <- m.Rcode
+			}(i)
+		}
+		gomega.Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(gomega.Equal(int32(2)))
+		close(release)
+		wg.Wait()
+		close(rcodes)
+
+		gomega.Expect(atomic.LoadInt32(&maxInFlight)).To(gomega.Equal(int32(2)))
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(20))
+		for rcode := range rcodes {
+			gomega.Expect(rcode).To(gomega.Equal(dns.RcodeSuccess))
+		}
+	})
+
+	ginkgo.It("should not limit the queries with a maximum of zero", func() {
+		server, err := New(nil, nil, []types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithMaxUpstreamQueries(0, false))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		var wg sync.WaitGroup
+		rcodes := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(fmt.Sprintf("host%d.example.com.", i), dns.TypeA))
+				rcodes <- m.Rcode
+			}(i)
+		}
+		gomega.Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(gomega.Equal(int32(3)))
+		close(release)
+		wg.Wait()
+		close(rcodes)
+
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(3))
+		for rcode := range rcodes {
+			gomega.Expect(rcode).To(gomega.Equal(dns.RcodeSuccess))
+		}
+	})
+
+	ginkgo.It("should fail the excess queries without queueing", func() {
+		server, err := New(nil, nil, []types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithMaxUpstreamQueries(1, false))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("first.example.com.", dns.TypeA))
+		}()
+		gomega.Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(gomega.Equal(int32(1)))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("second.example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+
+		// the local answers don't need a slot
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+
+		close(release)
+		<-done
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+	})
+})
+
+// countingListener counts the connections accepted by a nameserver.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func startCountingUpstream() (*dns.Server, *countingListener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	counting := &countingListener{Listener: ln}
+	upstream := &fakeUpstream{address: net.ParseIP("10.0.0.1"), ttl: 60}
+	return serveDNSListener(counting, upstream.handle), counting, nil
+}
+
+var _ = ginkgo.Describe("dns connection pool", func() {
+	var (
+		upstream *dns.Server
+		listener *countingListener
+		pool     *pooledClient
+	)
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		upstream, listener, err = startCountingUpstream()
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		pool = newPooledClient(&dns.Client{Net: "tcp"})
+	})
+
+	ginkgo.AfterEach(func() {
+		_ = upstream.Shutdown()
+	})
+
+	ginkgo.It("should reuse the connection for the next queries", func() {
+		for i := 0; i < 5; i++ {
+			resp, _, err := pool.ExchangeContext(context.Background(), query("example.com.", dns.TypeA), upstream.Listener.Addr().String())
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+		}
+		gomega.Expect(atomic.LoadInt32(&listener.accepted)).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("should not reuse the connections idle for too long", func() {
+		now := time.Now()
+		pool.now = func() time.Time { return now }
+		for i := 0; i < 2; i++ {
+			_, _, err := pool.ExchangeContext(context.Background(), query("example.com.", dns.TypeA), upstream.Listener.Addr().String())
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			now = now.Add(idleConnTimeout + time.Second)
+		}
+		gomega.Expect(atomic.LoadInt32(&listener.accepted)).To(gomega.Equal(int32(2)))
+	})
+
+	ginkgo.It("should retry on a new connection when the idle one was closed", func() {
+		address := upstream.Listener.Addr().String()
+		_, _, err := pool.ExchangeContext(context.Background(), query("example.com.", dns.TypeA), address)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		for _, idle := range pool.idle[address] {
+			idle.conn.Close()
+		}
+
+		resp, _, err := pool.ExchangeContext(context.Background(), query("example.com.", dns.TypeA), address)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+	})
+})
+
+func benchmarkTCPExchange(b *testing.B, exchanger Exchanger) {
+	upstream, listener, err := startCountingUpstream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = upstream.Shutdown()
+	}()
+	address := upstream.Listener.Addr().String()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := exchanger.ExchangeContext(context.Background(), query("example.com.", dns.TypeA), address); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(&listener.accepted))/float64(b.N), "conns/op")
+}
+
+func BenchmarkTCPExchange(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkTCPExchange(b, newPooledClient(&dns.Client{Net: "tcp"}))
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		benchmarkTCPExchange(b, &client{&dns.Client{Net: "tcp"}})
+	})
+}
@@ -0,0 +1,18 @@
+package dns
+
+import "github.com/miekg/dns"
+
+// addExtendedError explains the response code of m, the response to r, with
+// an extended DNS error (RFC 8914). It is only added if r uses EDNS0.
+func addExtendedError(m *dns.Msg, r *dns.Msg, code uint16, text string) {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, reqOpt.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
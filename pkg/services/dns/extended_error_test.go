@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func edns0Query(name string, qtype uint16) *dns.Msg {
+	r := query(name, qtype)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	return r
+}
+
+var _ = ginkgo.Describe("dns extended errors", func() {
+	var exchanger *mockExchanger
+
+	ginkgo.BeforeEach(func() {
+		exchanger = &mockExchanger{respond: func(*dns.Msg) (*dns.Msg, error) {
+			return nil, errors.New("connection refused")
+		}}
+	})
+
+	newServer := func(opts ...Option) *Server {
+		server, err := New(nil, nil, []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, append(opts, WithUpstream("192.168.1.1"), WithExchanger(exchanger))...)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		return server
+	}
+
+	ginkgo.It("should explain the SERVFAIL of an unreachable upstream", func() {
+		server := newServer()
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+		gomega.Expect(extendedError(m)).To(gomega.Equal(&dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNetworkError,
+			ExtraText: "upstream nameserver unreachable",
+		}))
+	})
+
+	ginkgo.It("should explain the refusal of a blocked name", func() {
+		server := newServer(WithLocalOnly("corp."))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("wiki.corp.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(extendedError(m).InfoCode).To(gomega.Equal(dns.ExtendedErrorCodeBlocked))
+		gomega.Expect(exchanger.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should explain the refusal of a server not forwarding", func() {
+		server := newServer(WithoutForwarding())
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(extendedError(m).InfoCode).To(gomega.Equal(dns.ExtendedErrorCodeNotAuthoritative))
+	})
+
+	ginkgo.It("should not add extended errors for clients without EDNS0", func() {
+		server := newServer()
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+		gomega.Expect(m.IsEdns0()).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should keep successful answers free of extended errors", func() {
+		server := newServer()
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("crc.internal.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(extendedError(m)).To(gomega.BeNil())
+	})
+})
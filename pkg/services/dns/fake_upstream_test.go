@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/gomega"
+)
+
+// fakeUpstream is a nameserver answering every A query with address.
+type fakeUpstream struct {
+	server  *dns.Server
+	address net.IP
+	ttl     uint32
+	queries int32
+	delay   int64
+}
+
+func startFakeUpstream(address string, ttl uint32) *fakeUpstream {
+	u := &fakeUpstream{address: net.ParseIP(address), ttl: ttl}
+	u.server = startDNSServer(u.handle)
+	return u
+}
+
+// startDNSServer runs handler on a random UDP port of localhost.
+func startDNSServer(handler dns.HandlerFunc) *dns.Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	return server
+}
+
+// startDNSServerTCP runs handler on a random TCP port of localhost.
+func startDNSServerTCP(handler dns.HandlerFunc) *dns.Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	return serveDNSListener(ln, handler)
+}
+
+// serveDNSListener runs handler on the TCP listener ln.
+func serveDNSListener(ln net.Listener, handler dns.HandlerFunc) *dns.Server {
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          ln,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	return server
+}
+
+// startDNSServerTLS runs handler over TLS on a random TCP port of
+// localhost, with a certificate for serverName signed by the returned root.
+func startDNSServerTLS(handler dns.HandlerFunc, serverName string) (*dns.Server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: serverName},
+		DNSNames:              []string{serverName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	})
+	gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	return serveDNSListener(ln, handler), roots
+}
+
+func (u *fakeUpstream) handle(w dns.ResponseWriter, r *dns.Msg) {
+	atomic.AddInt32(&u.queries, 1)
+	time.Sleep(time.Duration(atomic.LoadInt64(&u.delay)))
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   r.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    u.ttl,
+		},
+		A: u.address,
+	})
+	_ = w.WriteMsg(m)
+}
+
+// setDelay makes the upstream wait for delay before answering.
+func (u *fakeUpstream) setDelay(delay time.Duration) {
+	atomic.StoreInt64(&u.delay, int64(delay))
+}
+
+func (u *fakeUpstream) addr() string {
+	return u.server.PacketConn.LocalAddr().String()
+}
+
+func (u *fakeUpstream) queryCount() int {
+	return int(atomic.LoadInt32(&u.queries))
+}
+
+func (u *fakeUpstream) stop() {
+	_ = u.server.Shutdown()
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+// fakeResponseWriter records the message written by the handler.
+type fakeResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+	err    error
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.168.127.1"), Port: 53}
+}
+
+func (w *fakeResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.msg = m
+	return nil
+}
+
+func (w *fakeResponseWriter) Write(b []byte) (int, error) {
+	return len(b), w.err
+}
+
+func (w *fakeResponseWriter) Close() error {
+	return nil
+}
+
+func (w *fakeResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *fakeResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *fakeResponseWriter) Hijack() {}
+
+// unreachableUpstream is the upstream nameserver of the tests which don't
+// forward their queries, an address reserved for documentation (RFC 5737),
+// so that they don't depend on the nameservers of the host.
+const unreachableUpstream = "192.0.2.1"
+
+// newTestServer returns a server without listeners for zones, failing the
+// test if it can't be created.
+func newTestServer(zones []types.Zone, opts ...Option) *Server {
+	server, err := New(nil, nil, zones, opts...)
+	gomega.ExpectWithOffset(1, err).ShouldNot(gomega.HaveOccurred())
+	return server
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// flight is an upstream exchange shared by the identical queries arriving
+// while it is in progress.
+type flight struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// sharedExchange runs exchange once for the concurrent queries with the same
+// key, the ones arriving while it is in progress wait for its result, or
+// until their ctx is done. Each of them gets its own copy of the response,
+// unless it is truncated: they run their own exchange then.
+func (h *dnsHandler) sharedExchange(ctx context.Context, key cacheKey, exchange func() (*dns.Msg, error)) (*dns.Msg, error) {
+	h.flightsLock.Lock()
+	f, ok := h.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		h.flights[key] = f
+	}
+	h.flightsLock.Unlock()
+
+	if ok {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// a truncated response only suits a query over UDP, the waiting query
+		// may have come over TCP and be forwarded over TCP to get all of it
+		if f.err == nil && f.resp.Truncated {
+			return exchange()
+		}
+	} else {
+		f.resp, f.err = exchange()
+		h.flightsLock.Lock()
+		delete(h.flights, key)
+		h.flightsLock.Unlock()
+		close(f.done)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.resp.Copy(), nil
+}
@@ -0,0 +1,322 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// HostsFile resolves names from hosts files, reloaded when they change.
+type HostsFile interface {
+	// LookupByHostname returns the addresses of name, both IPv4 and IPv6
+	LookupByHostname(name string) []net.IP
+	// LookupByAddr returns the names of ip, in the order of the files
+	LookupByAddr(ip net.IP) []string
+	// Entries returns the names currently resolved from the files, sorted by name
+	Entries() []HostEntry
+	// Close stops watching the files, the names are no longer reloaded
+	Close() error
+}
+
+// HostEntry is a name of the hosts file with its addresses.
+type HostEntry struct {
+	Name string   `json:"name"`
+	IPs  []net.IP `json:"ips"`
+}
+
+type hosts struct {
+	// hosts files or directories of hosts files, the later ones override
+	// the names of the earlier ones
+	paths []string
+
+	lock  sync.RWMutex
+	names map[string][]net.IP
+	// names by address, keyed by IP.String()
+	addrs map[string][]string
+
+	watcher *fsnotify.Watcher
+	// done is closed by Close to end the watch, which closes stopped
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{}
+}
+
+// hostsLine is an address of a name, as read from a line of a hosts file.
+type hostsLine struct {
+	name string
+	ip   net.IP
+}
+
+// NewHostsFile reads the hosts files at paths, and watches them for
+// changes. The addresses of a name come from the last file defining it. A
+// path may be a directory whose files are read in the order of their names,
+// the hidden ones excepted. An empty path, or no path, stands for the hosts
+// file of the system. A missing file resolves no name until it is created.
+func NewHostsFile(paths ...string) (HostsFile, error) {
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	h := &hosts{done: make(chan struct{}), stopped: make(chan struct{})}
+	for _, path := range paths {
+		if path == "" {
+			path = defaultHostsFilePath()
+		}
+		h.paths = append(h.paths, filepath.Clean(path))
+	}
+	if err := h.update(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watched, err := watchHostsFiles(watcher, h.paths)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	h.watcher = watcher
+	go h.watch(watched)
+	return h, nil
+}
+
+// watchedHostsFiles are the paths whose events change the hosts files.
+type watchedHostsFiles struct {
+	files map[string]bool
+	// the directories of hosts files, whose entries are hosts files
+	dirs map[string]bool
+}
+
+func (w watchedHostsFiles) has(path string) bool {
+	return w.files[path] || w.dirs[filepath.Dir(path)]
+}
+
+// watchHostsFiles watches the hosts files at paths, the targets of the ones
+// which are symlinks, and the files of the ones which are directories. The
+// directories of the files are watched as the files may not exist yet, or
+// be replaced by a rename or removed, which ends the watch of a file. The
+// files themselves are watched as the watch of a directory doesn't tell
+// about the writes of its files on all the platforms.
+func watchHostsFiles(watcher *fsnotify.Watcher, paths []string) (watchedHostsFiles, error) {
+	watched := watchedHostsFiles{files: map[string]bool{}, dirs: map[string]bool{}}
+	for _, path := range paths {
+		for _, file := range []string{path, resolveSymlinks(path)} {
+			if watched.files[file] {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(file)); err != nil {
+				return watchedHostsFiles{}, err
+			}
+			if err := watcher.Add(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return watchedHostsFiles{}, err
+			}
+			watched.files[file] = true
+		}
+		files, err := hostsDirFiles(path)
+		if err != nil {
+			return watchedHostsFiles{}, err
+		}
+		if files == nil {
+			continue
+		}
+		watched.dirs[path] = true
+		watched.dirs[resolveSymlinks(path)] = true
+		for _, file := range files {
+			if err := watcher.Add(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return watchedHostsFiles{}, err
+			}
+		}
+	}
+	return watched, nil
+}
+
+// hostsDirFiles returns the paths of the files of the directory at path, in
+// the order of their names, the hidden ones and the directories excepted.
+// It returns nil if path is not a directory.
+func hostsDirFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		files = append(files, filepath.Join(path, entry.Name()))
+	}
+	return files, nil
+}
+
+func (h *hosts) LookupByHostname(name string) []net.IP {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.names[strings.ToLower(dns.Fqdn(name))]
+}
+
+func (h *hosts) LookupByAddr(ip net.IP) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.addrs[ip.String()]
+}
+
+func (h *hosts) Entries() []HostEntry {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	entries := make([]HostEntry, 0, len(h.names))
+	for name, ips := range h.names {
+		entries = append(entries, HostEntry{Name: name, IPs: append([]net.IP(nil), ips...)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+func (h *hosts) watch(watched watchedHostsFiles) {
+	defer close(h.stopped)
+	for {
+		select {
+		case <-h.done:
+			return
+		case event, ok := <-h.watcher.Events:
+			if !ok {
+				return
+			}
+			if !watched.has(filepath.Clean(event.Name)) {
+				continue
+			}
+			// a file replaced or created again must be watched again, a
+			// symlink may point to another file now, and a directory may
+			// have new files
+			if rewatched, err := watchHostsFiles(h.watcher, h.paths); err != nil {
+				log.Errorf("error watching hosts files %s: %v", strings.Join(h.paths, ", "), err)
+			} else {
+				watched = rewatched
+			}
+			// a change of permissions may make a file readable
+			if err := h.update(); err != nil {
+				log.Errorf("cannot reload hosts files %s: %v", strings.Join(h.paths, ", "), err)
+			}
+		case err, ok := <-h.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error watching hosts files %s: %v", strings.Join(h.paths, ", "), err)
+		}
+	}
+}
+
+// Close ends the watch of the files once it handled its current event.
+func (h *hosts) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+	<-h.stopped
+	return h.watcher.Close()
+}
+
+func (h *hosts) update() error {
+	var files [][]hostsLine
+	for _, path := range h.paths {
+		dirFiles, err := hostsDirFiles(path)
+		if err != nil {
+			return err
+		}
+		if dirFiles == nil {
+			dirFiles = []string{path}
+		}
+		for _, file := range dirFiles {
+			lines, err := parseHostsFile(file)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			files = append(files, lines)
+		}
+	}
+	names, addrs := mergeHostsFiles(files)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.names = names
+	h.addrs = addrs
+	return nil
+}
+
+// mergeHostsFiles returns the addresses of the names of the hosts files
+// whose lines are files, and the names of their addresses. The addresses of
+// a name are the ones of the last file defining it.
+func mergeHostsFiles(files [][]hostsLine) (map[string][]net.IP, map[string][]string) {
+	// the file defining each name
+	definedBy := map[string]int{}
+	for i, lines := range files {
+		for _, line := range lines {
+			definedBy[line.name] = i
+		}
+	}
+	names := make(map[string][]net.IP)
+	addrs := make(map[string][]string)
+	for i, lines := range files {
+		for _, line := range lines {
+			if definedBy[line.name] != i {
+				continue
+			}
+			names[line.name] = append(names[line.name], line.ip)
+			addrs[line.ip.String()] = append(addrs[line.ip.String()], line.name)
+		}
+	}
+	return names, addrs
+}
+
+// parseHostsFile returns the addresses of the names of the hosts file at
+// path, in the order of the file.
+func parseHostsFile(path string) ([]hostsLine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []hostsLine
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// a bad line is skipped so that it doesn't hide the other entries
+		if len(fields) < 2 {
+			log.Warnf("skipping line %d of hosts file %s: no hostname", lineNumber, path)
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			log.Warnf("skipping line %d of hosts file %s: invalid address %q", lineNumber, path, fields[0])
+			continue
+		}
+		for _, name := range fields[1:] {
+			lines = append(lines, hostsLine{name: strings.ToLower(dns.Fqdn(name)), ip: ip})
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,339 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns hosts file", func() {
+	var (
+		dir       string
+		upstream  *fakeUpstream
+		hostsFile HostsFile
+	)
+
+	writeHostsFile := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(os.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "dns-hosts")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		hostsFile, err = NewHostsFile(writeHostsFile("hosts", `127.0.0.1 localhost
+192.168.1.10 both.example.com
+fd00::10     both.example.com
+192.168.1.20 v4only.example.com
+`))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+		gomega.Expect(hostsFile.Close()).To(gomega.Succeed())
+		os.RemoveAll(dir)
+	})
+
+	newServer := func(opts ...Option) *Server {
+		return newTestServer([]types.Zone{}, append(opts, WithHostsFile(hostsFile), WithUpstream(upstream.addr()))...)
+	}
+
+	ginkgo.It("should answer each query type with the matching address family", func() {
+		server := newServer()
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("both.example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.1.10"))
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("both.example.com.", dns.TypeAAAA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal("fd00::10"))
+
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should forward queries for a family missing from the hosts file", func() {
+		server := newServer()
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("v4only.example.com.", dns.TypeAAAA))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should answer no data for a family missing from the hosts file when not forwarding", func() {
+		server := newServer(WithoutForwarding())
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("v4only.example.com.", dns.TypeAAAA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should answer PTR queries for the addresses of the hosts file", func() {
+		server := newServer()
+
+		for name, ptr := range map[string]string{
+			"10.1.168.192.in-addr.arpa.": "both.example.com.",
+			"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": "both.example.com.",
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypePTR))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.PTR).Ptr).To(gomega.Equal(ptr), name)
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("99.1.168.192.in-addr.arpa.", dns.TypePTR))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should update the names of the addresses when the hosts file changes", func() {
+		path := writeHostsFile("hosts.test", "127.0.0.1 entry1\n")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+		gomega.Expect(hostsFile.LookupByAddr(net.ParseIP("127.0.0.1"))).To(gomega.Equal([]string{"entry1."}))
+
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry2 alias\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() []string {
+			return hostsFile.LookupByAddr(net.ParseIP("127.0.0.1"))
+		}, 5).Should(gomega.Equal([]string{"entry2.", "alias."}))
+	})
+
+	ginkgo.It("should reload the hosts file when it changes", func() {
+		path := writeHostsFile("hosts.test", "127.0.0.1 entry1\n")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+		gomega.Expect(hostsFile.LookupByHostname("entry1")).To(gomega.HaveLen(1))
+
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry2 foobar\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("foobar"))
+		}, 5).Should(gomega.Equal(1))
+		gomega.Expect(hostsFile.LookupByHostname("entry1")).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should keep reloading the hosts file once replaced by a rename", func() {
+		path := writeHostsFile("hosts.test", "127.0.0.1 entry1\n")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		for _, name := range []string{"entry2", "entry3"} {
+			tmp := path + ".tmp"
+			gomega.Expect(os.WriteFile(tmp, []byte("127.0.0.1 "+name+"\n"), 0600)).To(gomega.Succeed())
+			gomega.Expect(os.Rename(tmp, path)).To(gomega.Succeed())
+			gomega.Eventually(func() int {
+				return len(hostsFile.LookupByHostname(name))
+			}, 5).Should(gomega.Equal(1))
+		}
+		// writes in place are still seen after the rename
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry4\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry4"))
+		}, 5).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should reload the hosts file once removed and created again", func() {
+		path := writeHostsFile("hosts.test", "127.0.0.1 entry1\n")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		gomega.Expect(os.Remove(path)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry1"))
+		}, 5).Should(gomega.Equal(0))
+
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry2\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry2"))
+		}, 5).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should follow the target of a symlinked hosts file", func() {
+		if runtime.GOOS == "windows" {
+			ginkgo.Skip("symlinks need privileges on Windows")
+		}
+		targets := filepath.Join(dir, "targets")
+		gomega.Expect(os.Mkdir(targets, 0700)).To(gomega.Succeed())
+		for _, name := range []string{"entry1", "entry2"} {
+			gomega.Expect(os.WriteFile(filepath.Join(targets, name), []byte("127.0.0.1 "+name+"\n"), 0600)).To(gomega.Succeed())
+		}
+		path := filepath.Join(dir, "hosts.link")
+		gomega.Expect(os.Symlink(filepath.Join(targets, "entry1"), path)).To(gomega.Succeed())
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+		gomega.Expect(hostsFile.LookupByHostname("entry1")).To(gomega.HaveLen(1))
+
+		// the target changes
+		gomega.Expect(os.WriteFile(filepath.Join(targets, "entry1"), []byte("127.0.0.1 entry1 alias\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("alias"))
+		}, 5).Should(gomega.Equal(1))
+
+		// the symlink points to another file
+		tmp := path + ".tmp"
+		gomega.Expect(os.Symlink(filepath.Join(targets, "entry2"), tmp)).To(gomega.Succeed())
+		gomega.Expect(os.Rename(tmp, path)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry2"))
+		}, 5).Should(gomega.Equal(1))
+		gomega.Expect(os.WriteFile(filepath.Join(targets, "entry2"), []byte("127.0.0.1 entry3\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry3"))
+		}, 5).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should resolve the names of the last hosts file defining them", func() {
+		system := writeHostsFile("system", "127.0.0.1 localhost\n192.168.1.10 both.example.com\n192.168.1.20 v4only.example.com\n")
+		project := writeHostsFile("project", "192.168.1.30 both.example.com\nfd00::30 both.example.com\n")
+		hostsFile, err := NewHostsFile(system, project)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		gomega.Expect(hostsFile.LookupByHostname("both.example.com")).To(gomega.Equal([]net.IP{net.ParseIP("192.168.1.30"), net.ParseIP("fd00::30")}))
+		gomega.Expect(hostsFile.LookupByHostname("v4only.example.com")).To(gomega.Equal([]net.IP{net.ParseIP("192.168.1.20")}))
+		gomega.Expect(hostsFile.LookupByAddr(net.ParseIP("192.168.1.10"))).To(gomega.BeEmpty())
+		gomega.Expect(hostsFile.LookupByAddr(net.ParseIP("192.168.1.30"))).To(gomega.Equal([]string{"both.example.com."}))
+	})
+
+	ginkgo.It("should read the files of a hosts directory in the order of their names", func() {
+		hostsDir := filepath.Join(dir, "hosts.d")
+		gomega.Expect(os.Mkdir(hostsDir, 0700)).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(filepath.Join(hostsDir, "20-project"), []byte("192.168.1.20 app\n"), 0600)).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(filepath.Join(hostsDir, "10-base"), []byte("192.168.1.10 app db\n"), 0600)).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(filepath.Join(hostsDir, ".hidden"), []byte("192.168.1.99 app hidden\n"), 0600)).To(gomega.Succeed())
+		hostsFile, err := NewHostsFile(writeHostsFile("base", "127.0.0.1 localhost\n"), hostsDir)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		gomega.Expect(hostsFile.LookupByHostname("app")).To(gomega.Equal([]net.IP{net.ParseIP("192.168.1.20")}))
+		gomega.Expect(hostsFile.LookupByHostname("db")).To(gomega.Equal([]net.IP{net.ParseIP("192.168.1.10")}))
+		gomega.Expect(hostsFile.LookupByHostname("localhost")).To(gomega.HaveLen(1))
+		gomega.Expect(hostsFile.LookupByHostname("hidden")).To(gomega.BeEmpty())
+
+		// a new file of the directory is read, and so are its changes
+		path := filepath.Join(hostsDir, "30-other")
+		gomega.Expect(os.WriteFile(path, []byte("192.168.1.30 app\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() []net.IP {
+			return hostsFile.LookupByHostname("app")
+		}, 5).Should(gomega.Equal([]net.IP{net.ParseIP("192.168.1.30")}))
+		gomega.Expect(os.WriteFile(path, []byte("192.168.1.31 app\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() []net.IP {
+			return hostsFile.LookupByHostname("app")
+		}, 5).Should(gomega.Equal([]net.IP{net.ParseIP("192.168.1.31")}))
+
+		gomega.Expect(os.Remove(path)).To(gomega.Succeed())
+		gomega.Eventually(func() []net.IP {
+			return hostsFile.LookupByHostname("app")
+		}, 5).Should(gomega.Equal([]net.IP{net.ParseIP("192.168.1.20")}))
+	})
+
+	ginkgo.It("should read a hosts directory once it is created", func() {
+		hostsDir := filepath.Join(dir, "hosts.d")
+		hostsFile, err := NewHostsFile(hostsDir)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		gomega.Expect(os.Mkdir(hostsDir, 0700)).To(gomega.Succeed())
+		gomega.Expect(os.WriteFile(filepath.Join(hostsDir, "project"), []byte("192.168.1.20 app\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("app"))
+		}, 5).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should skip the bad lines of the hosts file", func() {
+		hostsFile, err := NewHostsFile(writeHostsFile("bad", `# a comment line
+1.2.3.4 host # a note
+not-an-ip broken
+5.6.7.8
+9.9.9.9	spaced    other		 alias
+`))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+
+		gomega.Expect(hostsFile.LookupByHostname("host")).To(gomega.Equal([]net.IP{net.ParseIP("1.2.3.4")}))
+		for _, name := range []string{"spaced", "other", "alias"} {
+			gomega.Expect(hostsFile.LookupByHostname(name)).To(gomega.Equal([]net.IP{net.ParseIP("9.9.9.9")}))
+		}
+		for _, name := range []string{"broken", "note", "a", "#"} {
+			gomega.Expect(hostsFile.LookupByHostname(name)).To(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should load the hosts file once it is created", func() {
+		path := filepath.Join(dir, "created")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		defer hostsFile.Close()
+		gomega.Expect(hostsFile.LookupByHostname("entry1")).To(gomega.BeEmpty())
+
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry1\n"), 0600)).To(gomega.Succeed())
+		gomega.Eventually(func() int {
+			return len(hostsFile.LookupByHostname("entry1"))
+		}, 5).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should stop reloading the hosts file once closed", func() {
+		path := writeHostsFile("hosts.test", "127.0.0.1 entry1\n")
+		hostsFile, err := NewHostsFile(path)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(hostsFile.Close()).To(gomega.Succeed())
+		gomega.Expect(hostsFile.(*hosts).stopped).To(gomega.BeClosed())
+
+		gomega.Expect(os.WriteFile(path, []byte("127.0.0.1 entry2\n"), 0600)).To(gomega.Succeed())
+		gomega.Consistently(func() int {
+			return len(hostsFile.LookupByHostname("entry1"))
+		}, "500ms").Should(gomega.Equal(1))
+		gomega.Expect(hostsFile.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should be closed once ListenAndServe returns", func() {
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		tcpLn.Close()
+		server, err := New(nil, tcpLn, []types.Zone{}, WithHostsFile(hostsFile), WithUpstream(upstream.addr()))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		gomega.Expect(server.ListenAndServe(context.Background())).ToNot(gomega.Succeed())
+		gomega.Expect(hostsFile.(*hosts).stopped).To(gomega.BeClosed())
+	})
+
+	ginkgo.It("should list the entries of the hosts file on /hosts", func() {
+		server := newServer()
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hosts", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`[
+			{"name": "both.example.com.", "ips": ["192.168.1.10", "fd00::10"]},
+			{"name": "localhost.", "ips": ["127.0.0.1"]},
+			{"name": "v4only.example.com.", "ips": ["192.168.1.20"]}
+		]`))
+	})
+
+	ginkgo.It("should list no entries on /hosts without hosts file", func() {
+		server := newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hosts", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`[]`))
+	})
+})
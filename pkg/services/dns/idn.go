@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// asciiName returns name with its internationalized labels in their ASCII
+// (punycode) form, the form the names of the zones are compared in:
+// "café.internal." becomes "xn--caf-dma.internal.". The labels are given
+// either in UTF-8 or escaped as on the wire ("caf\195\169"). The other
+// labels, and the labels which are not valid IDNs, are left untouched.
+func asciiName(name string) string {
+	labels := dns.SplitDomainName(name)
+	converted := false
+	for i, label := range labels {
+		unicode := unescapeLabel(label)
+		if isASCII(unicode) || !utf8.ValidString(unicode) {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(unicode)
+		if err != nil {
+			continue
+		}
+		labels[i] = ascii
+		converted = true
+	}
+	if !converted {
+		return name
+	}
+	ascii := strings.Join(labels, ".")
+	if dns.IsFqdn(name) {
+		ascii += "."
+	}
+	return ascii
+}
+
+// asciiGlob is asciiName for the labels of glob without wildcards.
+func asciiGlob(glob string) string {
+	labels := strings.Split(glob, ".")
+	for i, label := range labels {
+		if !strings.ContainsAny(label, "*?[") {
+			labels[i] = asciiName(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// unescapeLabel replaces the \DDD escapes of the bytes outside of ASCII
+// in label with the bytes themselves.
+func unescapeLabel(label string) string {
+	if !strings.Contains(label, `\`) {
+		return label
+	}
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] == '\\' && i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			if n, _ := strconv.Atoi(label[i+1 : i+4]); n >= utf8.RuneSelf && n <= 0xff {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(label[i])
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
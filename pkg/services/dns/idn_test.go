@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"context"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns internationalized names", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		server, err = New(nil, nil, []types.Zone{
+			{
+				Name:      "café.internal.",
+				DefaultIP: net.ParseIP("192.168.127.2"),
+				Records: []types.Record{
+					{Name: "bücher", IP: net.ParseIP("192.168.127.3")},
+					{Glob: "*-straße", IP: net.ParseIP("192.168.127.4")},
+				},
+			},
+		}, WithUpstream(unreachableUpstream))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should convert the names of the zones to their ASCII form", func() {
+		zones := server.Zones()
+
+		gomega.Expect(zones[0].Name).To(gomega.Equal("xn--caf-dma.internal."))
+		gomega.Expect(zones[0].Records[0].Name).To(gomega.Equal("xn--bcher-kva"))
+		gomega.Expect(zones[0].Records[1].Glob).To(gomega.Equal("*-straße"))
+	})
+
+	ginkgo.It("should resolve the punycode names of a unicode zone", func() {
+		for name, ip := range map[string]string{
+			"xn--caf-dma.internal.":               "192.168.127.2",
+			"xn--bcher-kva.xn--caf-dma.internal.": "192.168.127.3",
+		} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(ip))
+			gomega.Expect(m.Answer[0].Header().Name).To(gomega.Equal(name))
+		}
+	})
+
+	ginkgo.It("should resolve the names sent in UTF-8 in the form of the query", func() {
+		name := `b\195\188cher.caf\195\169.internal.`
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.3"))
+		gomega.Expect(m.Question[0].Name).To(gomega.Equal(name))
+		gomega.Expect(m.Answer[0].Header().Name).To(gomega.Equal(name))
+	})
+
+	ginkgo.It("should remove a zone by its unicode name", func() {
+		gomega.Expect(server.RemoveZone("café.internal")).To(gomega.BeTrue())
+		gomega.Expect(server.Zones()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should leave the ASCII names untouched", func() {
+		gomega.Expect(asciiName("Web.Internal.")).To(gomega.Equal("Web.Internal."))
+		gomega.Expect(asciiName(`a\.b.internal.`)).To(gomega.Equal(`a\.b.internal.`))
+	})
+})
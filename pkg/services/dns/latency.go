@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// querySource is what answered a query.
+type querySource int
+
+const (
+	// sourceLocal are the answers of the local zones, and the errors of the
+	// queries which could not be forwarded
+	sourceLocal querySource = iota
+	sourceHosts
+	sourceBlocklist
+	sourceCache
+	sourceUpstream
+	numSources
+)
+
+var sourceNames = [numSources]string{"local", "hosts", "blocklist", "cache", "upstream"}
+
+const (
+	// the upper bounds of the buckets double from firstLatencyBucket, the
+	// last bucket counts the queries slower than all of them
+	firstLatencyBucket = 50 * time.Microsecond
+	numLatencyBuckets  = 20
+)
+
+// latencyHistogram counts the durations of the queries, updated atomically.
+type latencyHistogram struct {
+	buckets [numLatencyBuckets + 1]uint64
+}
+
+func latencyBucketBound(i int) time.Duration {
+	return firstLatencyBucket << i
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < numLatencyBuckets && d > latencyBucketBound(i) {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+}
+
+// LatencyStats are the number of queries and the percentiles of their
+// durations, in milliseconds. The percentiles are the upper bounds of the
+// buckets of the histogram they fall in.
+type LatencyStats struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	var buckets [numLatencyBuckets + 1]uint64
+	var stats LatencyStats
+	for i := range buckets {
+		buckets[i] = atomic.LoadUint64(&h.buckets[i])
+		stats.Count += buckets[i]
+	}
+	percentile := func(p float64) float64 {
+		if stats.Count == 0 {
+			return 0
+		}
+		rank := uint64(p * float64(stats.Count))
+		if rank == 0 {
+			rank = 1
+		}
+		var seen uint64
+		for i, count := range buckets {
+			seen += count
+			if seen >= rank {
+				// the slowest queries are reported at the bound of the last bucket
+				if i == numLatencyBuckets {
+					i--
+				}
+				return float64(latencyBucketBound(i)) / float64(time.Millisecond)
+			}
+		}
+		return 0
+	}
+	stats.P50 = percentile(0.50)
+	stats.P95 = percentile(0.95)
+	stats.P99 = percentile(0.99)
+	return stats
+}
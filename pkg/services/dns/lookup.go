@@ -0,0 +1,24 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Lookup resolves name for qtype the way the queries of the clients are,
+// from the local zones, the hosts file, the cache or the upstream nameserver,
+// without going through a socket. The queries forwarded to the upstream use
+// TCP, as the answer has no size limit. Failures to resolve name are
+// reported by the response code of the answer, an error is only returned
+// for an invalid name.
+func (s *Server) Lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid domain name %q", name)
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return s.handler.addAnswers(ctx, s.handler.tcpClient, nil, r), nil
+}
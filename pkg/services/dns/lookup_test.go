@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"context"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns lookup", func() {
+	var (
+		server   *Server
+		upstream *fakeUpstream
+	)
+
+	ginkgo.BeforeEach(func() {
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		var err error
+		// Lookup forwards over TCP, the fake upstream only listens on UDP
+		server, err = New(nil, nil, []types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithUpstream(upstream.addr()), WithExchanger(client{&dns.Client{Net: "udp"}}))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+	})
+
+	ginkgo.It("should resolve a name of the local zones", func() {
+		m, err := server.Lookup(context.Background(), "crc.internal", dns.TypeA)
+
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should resolve a name through the upstream nameserver", func() {
+		m, err := server.Lookup(context.Background(), "example.com.", dns.TypeA)
+
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should reject an invalid name", func() {
+		_, err := server.Lookup(context.Background(), "foo..example.com", dns.TypeA)
+
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,381 @@
+package dns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+type flushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+type removeResponse struct {
+	Removed int `json:"removed"`
+}
+
+type queryLogConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// blocklistStatus is the number of names of the blocklist, as reported by /blocklist.
+type blocklistStatus struct {
+	Blocked int `json:"blocked"`
+	Allowed int `json:"allowed"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: message})
+}
+
+// write guards handlers modifying the server with the API token, if any.
+func (s *Server) write(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handler)
+}
+
+// read guards read-only handlers with the API token, if configured to.
+func (s *Server) read(handler http.HandlerFunc) http.HandlerFunc {
+	if !s.apiTokenForReads {
+		return handler
+	}
+	return s.authenticate(handler)
+}
+
+func (s *Server) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.apiToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// serverConfig is the effective configuration of the server, as reported by /config.
+type serverConfig struct {
+	Upstreams  []string `json:"upstreams"`
+	DefaultTTL uint32   `json:"defaultTTL"`
+	Forwarding bool     `json:"forwarding"`
+	Cache      bool     `json:"cache"`
+	MaxStale   string   `json:"maxStale"`
+	Prefetch   bool     `json:"prefetch"`
+	Cookies    bool     `json:"cookies"`
+	QueryLog   bool     `json:"queryLog"`
+}
+
+func (s *Server) config() serverConfig {
+	return serverConfig{
+		Upstreams:  s.handler.upstreams(),
+		DefaultTTL: s.handler.defaultTTL,
+		Forwarding: s.handler.forwarding,
+		Cache:      s.handler.cache.maxEntries > 0,
+		MaxStale:   s.handler.cache.maxStale.String(),
+		Prefetch:   s.handler.cache.prefetchHits > 0,
+		Cookies:    s.handler.cookies != nil,
+		QueryLog:   s.QueryLog(),
+	}
+}
+
+// serverStats are the counters of the server, as reported by /stats.
+type serverStats struct {
+	// WriteErrors counts the responses which could not be written, by transport
+	WriteErrors map[string]uint64 `json:"writeErrors"`
+	// Latency are the durations of the queries, by source of their answers
+	Latency map[string]LatencyStats `json:"latency"`
+	// Upstreams is the health of the upstream nameservers, in order of preference
+	Upstreams []upstreamStatus `json:"upstreams"`
+	// RateLimited counts the queries refused or truncated as their client exceeded its rate
+	RateLimited uint64 `json:"rateLimited"`
+}
+
+// upstreamStatus is the health of an upstream nameserver, as reported by /stats.
+type upstreamStatus struct {
+	Address  string `json:"address"`
+	Up       bool   `json:"up"`
+	Failures uint64 `json:"failures"`
+}
+
+func (s *Server) stats() serverStats {
+	stats := serverStats{
+		WriteErrors: map[string]uint64{
+			"udp": atomic.LoadUint64(&s.handler.udpWriteErrors),
+			"tcp": atomic.LoadUint64(&s.handler.tcpWriteErrors),
+		},
+		Latency:     map[string]LatencyStats{},
+		Upstreams:   s.handler.upstreamStatuses(),
+		RateLimited: atomic.LoadUint64(&s.handler.rateLimitedQueries),
+	}
+	for source, name := range sourceNames {
+		stats.Latency[name] = s.handler.latencies[source].stats()
+	}
+	return stats
+}
+
+func (s *Server) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.read(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(s.config())
+	}))
+	mux.HandleFunc("/stats", s.read(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(s.stats())
+	}))
+	mux.HandleFunc("/all", s.read(func(w http.ResponseWriter, r *http.Request) {
+		// encode a snapshot so that a slow client doesn't hold the lock
+		_ = json.NewEncoder(w).Encode(zonesJSONOf(sortedZones(s.handler.snapshot())))
+	}))
+	mux.HandleFunc("/hosts", s.read(func(w http.ResponseWriter, r *http.Request) {
+		entries := []HostEntry{}
+		if s.handler.hostsFile != nil {
+			entries = s.handler.hostsFile.Entries()
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+	}))
+
+	// /add merges the records of the zone with the ones of the existing zone of the same name.
+	mux.HandleFunc("/add", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		req, err := decodeZone(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateZone(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		s.addZone(req)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// /zone replaces the existing zone of the same name, its records are discarded.
+	mux.HandleFunc("/zone", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			writeError(w, http.StatusMethodNotAllowed, "put only")
+			return
+		}
+		req, err := decodeZone(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateZone(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		s.replaceZone(req)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// /update replaces the settings of the existing zone of the same name, and
+	// its records with the same names, the other records are kept.
+	mux.HandleFunc("/update", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		req, err := decodeZone(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateZone(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		s.updateZone(req)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// /remove removes the records of the zone matching the same names as the
+	// ones given, whatever their data, or the whole zone if none is given. It
+	// reports the number of records removed.
+	mux.HandleFunc("/remove", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		req, err := decodeZone(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Name == "" {
+			writeError(w, http.StatusBadRequest, "zone name is empty")
+			return
+		}
+		for i, record := range req.Records {
+			if record.Name == "" && record.Regexp == nil && record.Glob == "" {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("record %d has neither a name nor a regexp or glob", i))
+				return
+			}
+		}
+
+		var removed int
+		var found bool
+		if len(req.Records) == 0 {
+			removed, found = s.removeZone(req.Name)
+		} else {
+			removed, found = s.RemoveRecords(req.Name, req.Records)
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no zone %s", req.Name))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(removeResponse{Removed: removed})
+	}))
+
+	// /validate checks a zone the way /add does, without adding it, and echoes it as parsed.
+	mux.HandleFunc("/validate", s.read(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		req, err := decodeZone(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateZone(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(zoneJSONOf(req))
+	}))
+
+	// /add-batch adds a list of zones at once. Nothing is added if one of them is invalid.
+	mux.HandleFunc("/add-batch", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		req, err := decodeZones(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for i, zone := range req {
+			if err := validateZone(zone); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("zone %d: %v", i, err))
+				return
+			}
+		}
+
+		s.addZones(req)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// /flush forgets the cached answers, only the ones for the name given and
+	// the names under it if any.
+	mux.HandleFunc("/flush", s.write(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "post only")
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name != "" {
+			if _, ok := dns.IsDomainName(name); !ok {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid name %q", name))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(flushResponse{Flushed: s.FlushCache(name)})
+	}))
+
+	// /query-log tells whether the queries are logged on GET, and enables or
+	// disables their logging on PUT.
+	mux.HandleFunc("/query-log", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.read(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(queryLogConfig{Enabled: s.QueryLog()})
+			})(w, r)
+		case http.MethodPut:
+			s.write(func(w http.ResponseWriter, r *http.Request) {
+				var req queryLogConfig
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				s.SetQueryLog(req.Enabled)
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(req)
+			})(w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+			writeError(w, http.StatusMethodNotAllowed, "get or put only")
+		}
+	})
+
+	// /blocklist tells the number of names of the blocklist on GET, and
+	// reloads its lists on POST.
+	mux.HandleFunc("/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus := func(w http.ResponseWriter) {
+			blocked, allowed := s.handler.blocklist.Len()
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(blocklistStatus{Blocked: blocked, Allowed: allowed})
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.read(func(w http.ResponseWriter, r *http.Request) {
+				if s.handler.blocklist == nil {
+					writeError(w, http.StatusNotFound, "no blocklist")
+					return
+				}
+				writeStatus(w)
+			})(w, r)
+		case http.MethodPost:
+			s.write(func(w http.ResponseWriter, r *http.Request) {
+				if s.handler.blocklist == nil {
+					writeError(w, http.StatusNotFound, "no blocklist")
+					return
+				}
+				if err := s.handler.blocklist.Reload(); err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				writeStatus(w)
+			})(w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "get or post only")
+		}
+	})
+	if s.cors != nil {
+		return s.cors.handler(mux)
+	}
+	return mux
+}
@@ -0,0 +1,551 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns mux", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+	})
+
+	post := func(path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	ginkgo.It("should report the configuration", func() {
+		server.handler.nameservers = []string{"192.168.1.1:5353"}
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{
+			"upstreams": ["192.168.1.1:5353"],
+			"defaultTTL": 0,
+			"forwarding": true,
+			"cache": true,
+			"maxStale": "0s",
+			"prefetch": false,
+			"cookies": false,
+			"queryLog": false
+		}`))
+	})
+
+	ginkgo.It("should count the responses which could not be written", func() {
+		server = newTestServer([]types.Zone{}, WithoutForwarding())
+		w := &fakeResponseWriter{err: errors.New("connection reset by peer")}
+		server.handler.handleUDP(w, query("example.com.", dns.TypeA))
+		server.handler.handleUDP(w, query("example.com.", dns.TypeA))
+		server.handler.handleTCP(w, query("example.com.", dns.TypeA))
+		server.handler.handleTCP(&fakeResponseWriter{}, query("example.com.", dns.TypeA))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		var stats serverStats
+		gomega.Expect(json.Unmarshal(rec.Body.Bytes(), &stats)).To(gomega.Succeed())
+		gomega.Expect(stats.WriteErrors).To(gomega.Equal(map[string]uint64{"udp": 2, "tcp": 1}))
+	})
+
+	ginkgo.It("should report the latency percentiles by source", func() {
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithoutForwarding())
+		for i := 0; i < 3; i++ {
+			server.handler.handleUDP(&fakeResponseWriter{}, query("crc.internal.", dns.TypeA))
+		}
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		var stats serverStats
+		gomega.Expect(json.Unmarshal(rec.Body.Bytes(), &stats)).To(gomega.Succeed())
+		gomega.Expect(stats.Latency["local"].Count).To(gomega.Equal(uint64(3)))
+		gomega.Expect(stats.Latency["local"].P50).To(gomega.BeNumerically(">", 0))
+		gomega.Expect(stats.Latency["local"].P99).To(gomega.BeNumerically(">=", stats.Latency["local"].P50))
+		gomega.Expect(stats.Latency["upstream"].Count).To(gomega.BeZero())
+		gomega.Expect(stats.Latency["hosts"].Count).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should compute the percentiles from the buckets of the histogram", func() {
+		var histogram latencyHistogram
+		for i := 0; i < 90; i++ {
+			histogram.observe(40 * time.Microsecond)
+		}
+		for i := 0; i < 10; i++ {
+			histogram.observe(time.Hour)
+		}
+
+		stats := histogram.stats()
+		gomega.Expect(stats.Count).To(gomega.Equal(uint64(100)))
+		gomega.Expect(stats.P50).To(gomega.Equal(0.05))
+		gomega.Expect(stats.P95).To(gomega.Equal(float64(latencyBucketBound(numLatencyBuckets-1)) / float64(time.Millisecond)))
+	})
+
+	ginkgo.It("should add a valid zone", func() {
+		rec := post("/add", `{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.2"}]}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(server.handler.zones).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should keep the metadata of the zones and records through /add and /all", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Metadata": {"owner": "infra"}, "Records": [{"Name": "crc", "IP": "192.168.127.2", "Metadata": {"source": "ci"}}]}`).Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(post("/add", `{"Name": "internal.", "Metadata": {"ticket": "42"}, "Records": [{"Name": "web", "IP": "192.168.127.3"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/all", nil))
+		var zones []types.Zone
+		gomega.Expect(json.Unmarshal(rec.Body.Bytes(), &zones)).To(gomega.Succeed())
+
+		gomega.Expect(zones[0].Metadata).To(gomega.Equal(map[string]string{"owner": "infra", "ticket": "42"}))
+		gomega.Expect(zones[0].Records[0].Name).To(gomega.Equal("crc"))
+		gomega.Expect(zones[0].Records[0].Metadata).To(gomega.Equal(map[string]string{"source": "ci"}))
+		gomega.Expect(zones[0].Records[1].Metadata).To(gomega.BeNil())
+		gomega.Expect(rec.Body.String()).NotTo(gomega.ContainSubstring(`"Metadata":null`))
+
+		// the metadata doesn't change the answers
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.2"))
+	})
+
+	ginkgo.It("should call the zone change hook after an /add", func() {
+		var changes [][]types.Zone
+		server = newTestServer([]types.Zone{}, WithZoneChangeHook(func(zones []types.Zone) {
+			// the hook can call back into the server
+			gomega.Expect(server.Zones()).To(gomega.Equal(zones))
+			changes = append(changes, zones)
+		}), WithUpstream(unreachableUpstream))
+
+		rec := post("/add", `{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.2"}]}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(changes).To(gomega.HaveLen(1))
+		gomega.Expect(changes[0]).To(gomega.HaveLen(1))
+		gomega.Expect(changes[0][0].Name).To(gomega.Equal("internal."))
+		gomega.Expect(changes[0][0].Records[0].Name).To(gomega.Equal("crc"))
+
+		gomega.Expect(server.RemoveZone("internal.")).To(gomega.BeTrue())
+		gomega.Expect(changes).To(gomega.HaveLen(2))
+		gomega.Expect(changes[1]).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should not lose records when adding to the same zones concurrently", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer ginkgo.GinkgoRecover()
+				defer wg.Done()
+				var rec *httptest.ResponseRecorder
+				if i%2 == 0 {
+					rec = post("/add", fmt.Sprintf(`{"Name": "internal.", "Records": [{"Name": "host%d", "IP": "192.168.127.2"}]}`, i))
+				} else {
+					rec = post("/add-batch", fmt.Sprintf(`[
+						{"Name": "internal.", "Records": [{"Name": "host%d", "IP": "192.168.127.2"}]},
+						{"Name": "testing.", "Records": [{"Name": "host%d", "IP": "192.168.127.3"}]}
+					]`, i, i))
+				}
+				gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+			}(i)
+		}
+		wg.Wait()
+
+		names := map[string][]string{}
+		for _, zone := range server.Zones() {
+			for _, record := range zone.Records {
+				names[zone.Name] = append(names[zone.Name], record.Name)
+			}
+		}
+		gomega.Expect(names["internal."]).To(gomega.HaveLen(50))
+		gomega.Expect(names["testing."]).To(gomega.HaveLen(25))
+		for i := 0; i < 50; i++ {
+			gomega.Expect(names["internal."]).To(gomega.ContainElement(fmt.Sprintf("host%d", i)))
+		}
+	})
+
+	for _, invalid := range []struct {
+		description string
+		body        string
+		message     string
+	}{
+		{"empty name", `{"Name": "", "DefaultIP": "192.168.127.2"}`, "zone name is empty"},
+		{"no records and no default IP", `{"Name": "internal."}`, "neither records nor a default IP"},
+		{"record without matcher", `{"Name": "internal.", "Records": [{"IP": "192.168.127.2"}]}`, "neither a name nor a regexp"},
+		{"record without data", `{"Name": "internal.", "Records": [{"Name": "crc"}]}`, "record has no data"},
+		{"IPv4 address as IPv6", `{"Name": "internal.", "Records": [{"Name": "crc", "IPv6": "192.168.127.2"}]}`, "is not an IPv6 address"},
+		{"invalid view", `{"Name": "internal.", "Records": [{"Name": "crc", "Views": [{"Subnet": "192.168.127.0", "IP": "192.168.127.2"}]}]}`, "invalid view"},
+		{"IPv6 hint over ipv4hint", `{"Name": "internal.", "Records": [{"Name": "web", "HTTPS": [{"Priority": 1, "IPv4Hint": ["fd00::1"]}]}]}`, "ipv4hint fd00::1 is not an IPv4 address"},
+		{"IPv4 default IPv6", `{"Name": "internal.", "DefaultIPv6": "192.168.127.2"}`, "default IPv6 192.168.127.2 is not an IPv6 address"},
+		{"bad glob", `{"Name": "internal.", "Records": [{"Glob": "web-[", "IP": "192.168.127.2"}]}`, "invalid glob"},
+		{"SOA without mailbox", `{"Name": "internal.", "DefaultIP": "192.168.127.2", "SOA": {"Ns": "ns1.internal."}}`, "SOA needs a nameserver and a mailbox"},
+		{"bad regexp", `{"Name": "internal.", "Records": [{"Regexp": "crc[", "IP": "192.168.127.2"}]}`, "missing closing ]"},
+		{"forwarder by name", `{"Name": "internal.", "Forwarder": "ns.example.com"}`, "is not an IP address"},
+	} {
+		invalid := invalid
+		ginkgo.It("should reject a zone with "+invalid.description, func() {
+			rec := post("/add", invalid.body)
+
+			gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+			gomega.Expect(rec.Body.String()).To(gomega.ContainSubstring(invalid.message))
+			gomega.Expect(server.handler.zones).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should report a zone with "+invalid.description+" on /validate", func() {
+			server.addZone(types.Zone{Name: "existing.", DefaultIP: net.ParseIP("192.168.127.1")})
+			zones := server.Zones()
+
+			rec := post("/validate", invalid.body)
+
+			gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+			gomega.Expect(rec.Body.String()).To(gomega.ContainSubstring(invalid.message))
+			gomega.Expect(server.Zones()).To(gomega.Equal(zones))
+		})
+	}
+
+	ginkgo.It("should echo a valid zone on /validate without adding it", func() {
+		rec := post("/validate", `{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.2"}, {"Regexp": "^api\\.", "IP": "192.168.127.3"}]}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		zone, err := decodeZone(rec.Body)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(zone.Name).To(gomega.Equal("internal."))
+		gomega.Expect(zone.Records).To(gomega.HaveLen(2))
+		gomega.Expect(zone.Records[1].Regexp.String()).To(gomega.Equal(`^api\.`))
+		gomega.Expect(server.handler.zones).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should only allow POST on /validate", func() {
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validate", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusMethodNotAllowed))
+	})
+
+	ginkgo.It("should return JSON errors", func() {
+		for _, rec := range []*httptest.ResponseRecorder{
+			post("/add", `{"Name": `),
+			post("/add", `{"Name": ""}`),
+		} {
+			gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+			gomega.Expect(rec.Header().Get("Content-Type")).To(gomega.Equal("application/json"))
+			var resp map[string]string
+			gomega.Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(gomega.Succeed())
+			gomega.Expect(resp).To(gomega.HaveKey("error"))
+			gomega.Expect(resp["error"]).NotTo(gomega.BeEmpty())
+		}
+	})
+
+	ginkgo.It("should only accept POST on /add", func() {
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/add", nil))
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusMethodNotAllowed))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"error": "post only"}`))
+	})
+
+	ginkgo.It("should merge the records of an existing zone on /add", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [{"Name": "old", "IP": "192.168.127.2"}]}`).Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [{"Name": "new", "IP": "192.168.127.3"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "new", IP: net.ParseIP("192.168.127.3")},
+				{Name: "old", IP: net.ParseIP("192.168.127.2")},
+			},
+		}}))
+	})
+
+	ginkgo.It("should replace an existing zone on PUT /zone", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [{"Name": "old", "IP": "192.168.127.2"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/zone", strings.NewReader(`{"Name": "internal.", "Records": [{"Name": "new", "IP": "192.168.127.3"}]}`)))
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "new", IP: net.ParseIP("192.168.127.3")}},
+		}}))
+		gomega.Expect(post("/zone", `{}`).Code).To(gomega.Equal(http.StatusMethodNotAllowed))
+	})
+
+	ginkgo.It("should update the records with the same names on /update", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "DefaultIP": "192.168.127.1", "Records": [
+			{"Name": "crc", "IP": "192.168.127.2"},
+			{"Glob": "web-*", "IP": "192.168.127.3"}
+		]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		gomega.Expect(post("/update", `{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.4"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{
+				{Name: "crc", IP: net.ParseIP("192.168.127.4")},
+				{Glob: "web-*", IP: net.ParseIP("192.168.127.3")},
+			},
+		}}))
+		gomega.Expect(post("/update", `{"Name": "internal.", "Records": [{"Name": "crc"}]}`).Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should remove the records with the given names on /remove", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [
+			{"Name": "crc", "IP": "192.168.127.2"},
+			{"Name": "crc", "IPv6": "fd00::2"},
+			{"Glob": "web-*", "IP": "192.168.127.3"},
+			{"Name": "host", "IP": "192.168.127.254"}
+		]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		rec := post("/remove", `{"Name": "internal", "Records": [{"Name": "crc"}, {"Glob": "web-*"}, {"Name": "missing"}]}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"removed": 3}`))
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "host", IP: net.ParseIP("192.168.127.254")}},
+		}}))
+	})
+
+	ginkgo.It("should remove a whole zone on /remove", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.2"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		rec := post("/remove", `{"Name": "internal."}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"removed": 1}`))
+		gomega.Expect(server.Zones()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should report the zones missing on /remove", func() {
+		rec := post("/remove", `{"Name": "internal."}`)
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusNotFound))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"error": "no zone internal."}`))
+
+		rec = post("/remove", `{"Name": "internal.", "Records": [{"IP": "192.168.127.2"}]}`)
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("should add a batch of zones", func() {
+		rec := post("/add-batch", `[
+			{"Name": "internal.", "Records": [{"Name": "crc", "IP": "192.168.127.2"}]},
+			{"Name": "testing.", "DefaultIP": "192.168.127.3"},
+			{"Name": "internal.", "Records": [{"Name": "host", "IP": "192.168.127.254"}]}
+		]`)
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{
+			{
+				Name: "internal.",
+				Records: []types.Record{
+					{Name: "host", IP: net.ParseIP("192.168.127.254")},
+					{Name: "crc", IP: net.ParseIP("192.168.127.2")},
+				},
+			},
+			{
+				Name:      "testing.",
+				DefaultIP: net.ParseIP("192.168.127.3"),
+			},
+		}))
+	})
+
+	ginkgo.It("should not add any zone of a batch containing an invalid one", func() {
+		rec := post("/add-batch", `[{"Name": "internal.", "DefaultIP": "192.168.127.2"}, {"Name": ""}]`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"error": "zone 1: zone name is empty"}`))
+		gomega.Expect(server.handler.zones).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should list the zones and their records sorted by name", func() {
+		gomega.Expect(server.SetZones([]types.Zone{
+			{Name: "testing.", DefaultIP: net.ParseIP("192.168.127.3")},
+			{Name: "internal.", Records: []types.Record{
+				{Name: "host", IP: net.ParseIP("192.168.127.254")},
+				{Regexp: regexp.MustCompile("^b.*"), IP: net.ParseIP("192.168.127.5")},
+				{Name: "crc", IP: net.ParseIP("192.168.127.2")},
+				{Regexp: regexp.MustCompile("^a.*"), IP: net.ParseIP("192.168.127.4")},
+			}},
+		})).To(gomega.Succeed())
+
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/all", nil))
+
+		var zones []struct {
+			Name    string
+			Records []struct {
+				Name   string
+				Regexp string
+			}
+		}
+		gomega.Expect(json.Unmarshal(rec.Body.Bytes(), &zones)).To(gomega.Succeed())
+		gomega.Expect(zones).To(gomega.HaveLen(2))
+		gomega.Expect(zones[0].Name).To(gomega.Equal("internal."))
+		gomega.Expect(zones[1].Name).To(gomega.Equal("testing."))
+		var records []string
+		for _, record := range zones[0].Records {
+			records = append(records, record.Name+record.Regexp)
+		}
+		gomega.Expect(records).To(gomega.Equal([]string{"^a.*", "^b.*", "crc", "host"}))
+
+		// the order used for matching is unchanged
+		gomega.Expect(server.handler.zones[0].Name).To(gomega.Equal("testing."))
+		gomega.Expect(server.handler.zones[1].Records[0].Name).To(gomega.Equal("host"))
+	})
+
+	ginkgo.It("should resolve queries while a slow client reads /all", func() {
+		gomega.Expect(server.AddZone(types.Zone{Name: "internal.", Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}}})).To(gomega.Succeed())
+
+		w := &slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+		defer close(w.release)
+		go server.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/all", nil))
+		<-w.writing
+
+		// a pending writer must not queue the lookups behind the slow read
+		added := make(chan error, 1)
+		go func() {
+			added <- server.AddZone(types.Zone{Name: "testing.", DefaultIP: net.ParseIP("192.168.127.3")})
+		}()
+		gomega.Eventually(added, "1s").Should(gomega.Receive(gomega.Succeed()))
+
+		answered := make(chan *dns.Msg, 1)
+		go func() {
+			answered <- server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		}()
+		var m *dns.Msg
+		gomega.Eventually(answered, "1s").Should(gomega.Receive(&m))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+})
+
+// slowResponseWriter blocks the first write until release is closed.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	once    sync.Once
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+var _ = ginkgo.Describe("dns mux authentication", func() {
+	request := func(server *Server, method string, path string, token string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"Name": "internal.", "DefaultIP": "192.168.127.2"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	ginkgo.It("should reject modifications without a valid token", func() {
+		server := newTestServer([]types.Zone{}, WithAPIToken("secret", false), WithUpstream(unreachableUpstream))
+
+		gomega.Expect(request(server, http.MethodPost, "/add", "")).To(gomega.Equal(http.StatusUnauthorized))
+		gomega.Expect(request(server, http.MethodPost, "/add", "wrong")).To(gomega.Equal(http.StatusUnauthorized))
+		gomega.Expect(request(server, http.MethodPost, "/add-batch", "")).To(gomega.Equal(http.StatusUnauthorized))
+		gomega.Expect(server.handler.zones).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should accept modifications with a valid token", func() {
+		server := newTestServer([]types.Zone{}, WithAPIToken("secret", false), WithUpstream(unreachableUpstream))
+
+		gomega.Expect(request(server, http.MethodPost, "/add", "secret")).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(server.handler.zones).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should guard reads only when configured to", func() {
+		server := newTestServer([]types.Zone{}, WithAPIToken("secret", false), WithUpstream(unreachableUpstream))
+		gomega.Expect(request(server, http.MethodGet, "/all", "")).To(gomega.Equal(http.StatusOK))
+
+		server = newTestServer([]types.Zone{}, WithAPIToken("secret", true), WithUpstream(unreachableUpstream))
+		gomega.Expect(request(server, http.MethodGet, "/all", "")).To(gomega.Equal(http.StatusUnauthorized))
+		gomega.Expect(request(server, http.MethodGet, "/all", "secret")).To(gomega.Equal(http.StatusOK))
+	})
+})
+
+var _ = ginkgo.Describe("dns mux CORS", func() {
+	preflightMethod := func(server *Server, origin string, path string, method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, req)
+		return rec
+	}
+
+	preflight := func(server *Server, origin string) *httptest.ResponseRecorder {
+		return preflightMethod(server, origin, "/add", http.MethodPost)
+	}
+
+	ginkgo.It("should answer preflight requests of allowed origins", func() {
+		server := newTestServer([]types.Zone{}, WithCORS(CORSConfig{AllowedOrigins: []string{"http://localhost:8080"}}), WithUpstream(unreachableUpstream))
+
+		rec := preflight(server, "http://localhost:8080")
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusNoContent))
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(gomega.Equal("http://localhost:8080"))
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Methods")).To(gomega.Equal("GET, POST, PUT, OPTIONS"))
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Headers")).To(gomega.Equal("Authorization, Content-Type"))
+
+		req := httptest.NewRequest(http.MethodGet, "/all", nil)
+		req.Header.Set("Origin", "http://localhost:8080")
+		rec = httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, req)
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(gomega.Equal("http://localhost:8080"))
+	})
+
+	ginkgo.It("should allow the PUT requests of the API by default", func() {
+		server := newTestServer([]types.Zone{}, WithCORS(CORSConfig{AllowedOrigins: []string{"http://localhost:8080"}}), WithUpstream(unreachableUpstream))
+
+		for _, path := range []string{"/zone", "/query-log"} {
+			rec := preflightMethod(server, "http://localhost:8080", path, http.MethodPut)
+			gomega.Expect(rec.Code).To(gomega.Equal(http.StatusNoContent))
+			gomega.Expect(strings.Split(rec.Header().Get("Access-Control-Allow-Methods"), ", ")).To(gomega.ContainElement(http.MethodPut))
+		}
+	})
+
+	ginkgo.It("should not allow other origins", func() {
+		server := newTestServer([]types.Zone{}, WithCORS(CORSConfig{AllowedOrigins: []string{"http://localhost:8080"}}), WithUpstream(unreachableUpstream))
+
+		rec := preflight(server, "http://evil.example.com")
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should not send CORS headers by default", func() {
+		server := newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+
+		rec := preflight(server, "http://localhost:8080")
+		gomega.Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(gomega.BeEmpty())
+	})
+})
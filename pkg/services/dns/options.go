@@ -0,0 +1,388 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+)
+
+// Option configures optional behaviors of the DNS server.
+type Option func(*Server)
+
+// WithStaleServing allows answers from the cache to be served for up to
+// maxStale after their TTL expired. A stale answer triggers a refresh from
+// the upstream nameserver in the background, and keeps being served while
+// the upstream cannot be reached.
+func WithStaleServing(maxStale time.Duration) Option {
+	return func(s *Server) {
+		s.handler.cache.maxStale = maxStale
+	}
+}
+
+// WithCacheSize bounds the number of answers cached from the upstream
+// nameserver to entries, 10000 by default, 0 disables the cache. Once full,
+// a new answer evicts the expired ones, or else the one expiring first.
+func WithCacheSize(entries int) Option {
+	return func(s *Server) {
+		s.handler.cache.maxEntries = entries
+	}
+}
+
+// WithContext bounds the lifetime of the server to ctx. When ctx is cancelled,
+// in-flight queries to the upstream nameserver are cancelled too.
+func WithContext(ctx context.Context) Option {
+	return func(s *Server) {
+		s.handler.ctx = ctx
+	}
+}
+
+// WithPrefetch refreshes cached answers from the upstream nameserver shortly
+// before they expire, provided they were served at least minHits times.
+// Rarely queried names are left to expire.
+func WithPrefetch(minHits int) Option {
+	return func(s *Server) {
+		s.handler.cache.prefetchHits = minHits
+	}
+}
+
+// WithAPIToken requires the requests to the HTTP API modifying the server to
+// carry token in an "Authorization: Bearer" header. Read-only requests are
+// also guarded when forReads is true.
+func WithAPIToken(token string, forReads bool) Option {
+	return func(s *Server) {
+		s.apiToken = token
+		s.apiTokenForReads = forReads
+	}
+}
+
+// WithCookies adds DNS cookies (RFC 7873) to the queries sent to the upstream
+// nameserver, protecting against off-path spoofing of its responses.
+func WithCookies() Option {
+	return func(s *Server) {
+		s.handler.cookies = newCookies()
+	}
+}
+
+// WithTracer records a span for each query handled by the server, with child
+// spans for the lookup in the local zones and the upstream exchange.
+func WithTracer(tracer Tracer) Option {
+	return func(s *Server) {
+		s.handler.tracer = tracer
+	}
+}
+
+// WithNameRedaction rewrites the query names recorded in the logs and the
+// traces with redact, such as HashNames or TruncateNames. Full names are
+// recorded by default.
+func WithNameRedaction(redact NameRedactor) Option {
+	return func(s *Server) {
+		s.handler.redact = redact
+	}
+}
+
+// WithCORS allows browsers to call the HTTP API from the origins of config.
+// Cross origin requests are denied by default.
+func WithCORS(config CORSConfig) Option {
+	return func(s *Server) {
+		s.cors = &config
+	}
+}
+
+// WithRandomSeed seeds the random choice between weighted records and the
+// shuffling of the answers, making them reproducible.
+func WithRandomSeed(seed int64) Option {
+	return func(s *Server) {
+		s.handler.rand = rand.New(rand.NewSource(seed)) // #nosec G404 -- no need for a secure source to spread answers
+	}
+}
+
+// WithAnswerOrder sets the order of the records of the answers, such as
+// OrderShuffled to spread the clients over the addresses of a name. The
+// records are answered as is by default.
+func WithAnswerOrder(order AnswerOrder) Option {
+	return func(s *Server) {
+		s.handler.order = order
+	}
+}
+
+// WithoutForwarding makes the server authoritative-only: names missing the
+// local zones are never sent to the upstream nameserver, and get REFUSED
+// unless configured otherwise with WithMissRcode. The server then starts
+// even if no nameserver is configured on the host.
+func WithoutForwarding() Option {
+	return func(s *Server) {
+		s.handler.forwarding = false
+	}
+}
+
+// WithMissRcode sets the response code of the queries missing the local zones
+// when the server doesn't forward them, such as dns.RcodeNameError. It also
+// applies to the names under the suffixes of WithLocalOnly, and to the
+// queries without the recursion desired flag.
+func WithMissRcode(rcode int) Option {
+	return func(s *Server) {
+		s.handler.missRcode = rcode
+	}
+}
+
+// WithLocalOnly prevents the names under suffixes, such as an internal TLD,
+// from leaking to the upstream nameserver. The ones missing the local zones
+// and the hosts file get REFUSED unless configured otherwise with WithMissRcode,
+// such as dns.RcodeNameError to answer that they don't exist.
+func WithLocalOnly(suffixes ...string) Option {
+	return func(s *Server) {
+		for _, suffix := range suffixes {
+			s.handler.localOnly = append(s.handler.localOnly, strings.ToLower(asciiName(dns.Fqdn(suffix))))
+		}
+	}
+}
+
+// WithHostsFile resolves the names missing the local zones from hostsFile
+// before forwarding them to the upstream nameserver. ListenAndServe closes
+// hostsFile once the server stopped.
+func WithHostsFile(hostsFile HostsFile) Option {
+	return func(s *Server) {
+		s.handler.hostsFile = hostsFile
+	}
+}
+
+// WithBlocklist answers the names blocked by blocklist, which are missing the
+// local zones and the hosts file, according to its mode instead of
+// forwarding them.
+func WithBlocklist(blocklist *Blocklist) Option {
+	return func(s *Server) {
+		s.handler.blocklist = blocklist
+	}
+}
+
+// WithQueryLog logs the queries and their responses from the start, see
+// Server.SetQueryLog.
+func WithQueryLog() Option {
+	return func(s *Server) {
+		s.SetQueryLog(true)
+	}
+}
+
+// WithUpstream forwards the queries to the nameserver at address instead of
+// the one configured on the host. address is a host with an optional port,
+// 53 by default, such as a local stub resolver on 127.0.0.1:5353.
+func WithUpstream(address string) Option {
+	return func(s *Server) {
+		s.SetUpstream(address)
+	}
+}
+
+// WithUpstreams forwards the queries to the nameservers at addresses instead
+// of the ones configured on the host, failing over to the next one when a
+// nameserver doesn't answer. The addresses are given as to WithUpstream.
+func WithUpstreams(addresses ...string) Option {
+	return func(s *Server) {
+		s.SetUpstreams(addresses...)
+	}
+}
+
+// WithDefaultTTL sets the TTL of the answers from the local zones and the
+// hosts file, 0 by default. The TTL of a zone or of a record overrides it.
+func WithDefaultTTL(ttl uint32) Option {
+	return func(s *Server) {
+		s.handler.defaultTTL = ttl
+	}
+}
+
+// WithTTLBounds keeps the TTLs of the answers of the upstream nameserver
+// between minTTL and maxTTL, in seconds, before they are cached. A maxTTL of 0
+// sets no ceiling. The TTLs of the local answers are left as configured.
+func WithTTLBounds(minTTL, maxTTL uint32) Option {
+	return func(s *Server) {
+		s.handler.minTTL = minTTL
+		s.handler.maxTTL = maxTTL
+	}
+}
+
+// WithRateLimit bounds the rate of the queries of each client, by IP
+// address, to rate per second with bursts of up to burst queries. The
+// queries over the limit are answered over UDP with an empty truncated
+// response, so that the legitimate clients retry over TCP, and over TCP
+// with REFUSED. A burst of zero or less allows a second of queries, and at
+// least one.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		if burst < 1 {
+			burst = int(math.Max(math.Ceil(rate), 1))
+		}
+		s.handler.rateLimiter = newRateLimiter(rate, burst)
+	}
+}
+
+// WithMaxUpstreamQueries bounds the number of queries in flight to the
+// upstream nameserver, including the refreshes of the cache, to max. The
+// excess queries wait for a free slot when queue is true, up to the timeout of
+// the upstream queries, and get SERVFAIL right away otherwise. The local
+// answers are never limited. A max of zero or less leaves the queries
+// unlimited.
+func WithMaxUpstreamQueries(max int, queue bool) Option {
+	return func(s *Server) {
+		if max <= 0 {
+			s.handler.upstreamSlots = nil
+			return
+		}
+		s.handler.upstreamSlots = make(chan struct{}, max)
+		s.handler.queueUpstream = queue
+	}
+}
+
+// WithCacheStatus tells the clients using EDNS0 whether the forwarded answers
+// were served from the cache, with a "hit", "miss" or "stale" local option
+// (code 65001), and logs it at the debug level. It is meant for debugging
+// the cache.
+func WithCacheStatus() Option {
+	return func(s *Server) {
+		s.handler.cacheStatus = true
+	}
+}
+
+// WithRootHints answers the NS queries of the root zone with the nameservers,
+// such as "a.root-servers.net.". They are refused by default, and never
+// forwarded.
+func WithRootHints(nameservers ...string) Option {
+	return func(s *Server) {
+		for _, ns := range nameservers {
+			s.handler.rootHints = append(s.handler.rootHints, dns.Fqdn(ns))
+		}
+	}
+}
+
+// WithChaosIdentity answers the TXT queries of the CHAOS class identifying
+// the server: version.bind with version, hostname.bind and id.server with
+// hostname. An empty value refuses the corresponding queries, which is the
+// default so as not to help fingerprinting.
+func WithChaosIdentity(version, hostname string) Option {
+	return func(s *Server) {
+		s.handler.chaosVersion = version
+		s.handler.chaosHostname = hostname
+	}
+}
+
+// WithBogusNXDomain rewrites to NXDOMAIN the answers of the upstream
+// nameserver whose addresses are all among ips, such as the ones of the
+// search pages some ISPs answer instead of NXDOMAIN.
+func WithBogusNXDomain(ips ...net.IP) Option {
+	return func(s *Server) {
+		if s.handler.bogusNXDomain == nil {
+			s.handler.bogusNXDomain = map[string]bool{}
+		}
+		for _, ip := range ips {
+			s.handler.bogusNXDomain[ip.String()] = true
+		}
+	}
+}
+
+// WithZoneChangeHook calls hook with a copy of the zones after each update
+// of the zones, through the HTTP API, AddZone, RemoveZone or SetZones. It is
+// called outside of the lock of the zones and may call the server, but
+// concurrent updates can call it concurrently.
+func WithZoneChangeHook(hook func(zones []types.Zone)) Option {
+	return func(s *Server) {
+		s.handler.onZoneChange = hook
+	}
+}
+
+// TCPOptions tunes the connections accepted by ServeTCP. The zero values
+// keep the defaults of the dns package.
+type TCPOptions struct {
+	// ReadTimeout bounds the wait for the first query of a connection
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the write of a response
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a connection stays open waiting for another query (RFC 7766), told to the clients
+	// asking with the edns-tcp-keepalive option (RFC 7828)
+	IdleTimeout time.Duration
+	// MaxQueries is the number of queries answered before closing a connection, -1 for unlimited
+	MaxQueries int
+	// KeepAlive is the period of the TCP keepalive probes detecting the dead clients, negative disables them.
+	// Zero leaves the connections of the listener as they are
+	KeepAlive time.Duration
+}
+
+// WithTCPOptions sets the timeouts and limits of the TCP connections, such as
+// a longer idle timeout for clients reusing their connection for many queries.
+func WithTCPOptions(tcpOptions TCPOptions) Option {
+	return func(s *Server) {
+		s.tcpOptions = tcpOptions
+		s.handler.tcpIdleTimeout = defaultTCPIdleTimeout
+		if tcpOptions.IdleTimeout != 0 {
+			s.handler.tcpIdleTimeout = tcpOptions.IdleTimeout
+		}
+	}
+}
+
+// WithTCPUpstream forwards all the queries to the upstream nameserver over
+// TCP, including the ones received over UDP, for networks where UDP is
+// blocked. The responses to UDP clients are still truncated to fit.
+func WithTCPUpstream() Option {
+	return func(s *Server) {
+		s.handler.udpClient = s.handler.tcpClient
+	}
+}
+
+// WithTLSUpstream forwards the queries to the nameserver at address over TLS
+// (RFC 7858), for networks where plain DNS is blocked. address is a host
+// with an optional port, 853 by default. The certificate of the nameserver
+// is verified for config.ServerName, the host of address by default, with
+// the roots of config, the ones of the system by default. config may be nil.
+func WithTLSUpstream(address string, config *tls.Config) Option {
+	return func(s *Server) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			host, port = strings.Trim(address, "[]"), "853"
+		}
+		if config == nil {
+			config = &tls.Config{}
+		} else {
+			config = config.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if config.MinVersion == 0 {
+			config.MinVersion = tls.VersionTLS12
+		}
+		tlsClient := newPooledClient(&dns.Client{Net: "tcp-tls", TLSConfig: config})
+		s.handler.udpClient = tlsClient
+		s.handler.tcpClient = tlsClient
+		s.upstreamPort = "853"
+		s.SetUpstream(net.JoinHostPort(host, port))
+	}
+}
+
+// WithHTTPSUpstream forwards the queries to the DNS over HTTPS endpoint at
+// url (RFC 8484), such as https://dns.example.com/dns-query, for networks
+// only allowing HTTPS. The requests go through httpClient, or if nil through
+// a client using the proxy of the host given by the HTTPS_PROXY and NO_PROXY
+// environment variables.
+func WithHTTPSUpstream(url string, httpClient *http.Client) Option {
+	return func(s *Server) {
+		dohClient := newDoHClient(httpClient)
+		s.handler.udpClient = dohClient
+		s.handler.tcpClient = dohClient
+		s.SetUpstream(url)
+	}
+}
+
+// WithExchanger sends the queries forwarded to the upstream nameserver
+// through exchanger, such as an alternate transport, instead of plain DNS
+// over UDP and TCP.
+func WithExchanger(exchanger Exchanger) Option {
+	return func(s *Server) {
+		s.handler.udpClient = exchanger
+		s.handler.tcpClient = exchanger
+	}
+}
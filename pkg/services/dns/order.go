@@ -0,0 +1,63 @@
+package dns
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerOrder is the order of the records of a same name and type in the
+// answers, from the local zones as well as from the upstream nameserver.
+type AnswerOrder int
+
+const (
+	// OrderAsIs keeps the order of the local zones and of the upstream nameserver.
+	OrderAsIs AnswerOrder = iota
+	// OrderSorted sorts the records, every client gets the same order.
+	OrderSorted
+	// OrderShuffled shuffles the records, spreading the clients over them.
+	OrderShuffled
+)
+
+// orderAnswers reorders the records of the answer section of m. Only the
+// records of a same name and type are moved, so that CNAME chains are kept.
+func (h *dnsHandler) orderAnswers(m *dns.Msg) {
+	if h.order == OrderAsIs {
+		return
+	}
+	for start := 0; start < len(m.Answer); {
+		end := start + 1
+		for end < len(m.Answer) && sameRRset(m.Answer[start], m.Answer[end]) {
+			end++
+		}
+		h.orderRRset(m.Answer[start:end])
+		start = end
+	}
+}
+
+func (h *dnsHandler) orderRRset(rrset []dns.RR) {
+	if len(rrset) < 2 {
+		return
+	}
+	switch h.order {
+	case OrderSorted:
+		sort.SliceStable(rrset, func(i, j int) bool {
+			return rdata(rrset[i]) < rdata(rrset[j])
+		})
+	case OrderShuffled:
+		h.randLock.Lock()
+		defer h.randLock.Unlock()
+		h.rand.Shuffle(len(rrset), func(i, j int) {
+			rrset[i], rrset[j] = rrset[j], rrset[i]
+		})
+	}
+}
+
+func sameRRset(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype && dns.CanonicalName(a.Header().Name) == dns.CanonicalName(b.Header().Name)
+}
+
+// rdata returns the presentation format of the data of rr, without its header.
+func rdata(rr dns.RR) string {
+	return rr.String()[len(rr.Header().String()):]
+}
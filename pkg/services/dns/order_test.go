@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"context"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// answerChain answers a CNAME to target.example.com. followed by several A records.
+func answerChain(m *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "target.example.com.",
+	})
+	for _, ip := range []string{"10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.2"} {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "target.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return resp, nil
+}
+
+func answerOrder(m *dns.Msg) []string {
+	var order []string
+	for _, rr := range m.Answer {
+		order = append(order, rdata(rr))
+	}
+	return order
+}
+
+var _ = ginkgo.Describe("dns answer order", func() {
+	newServer := func(opts ...Option) *Server {
+		exchanger := &mockExchanger{respond: answerChain}
+		server, err := New(nil, nil, []types.Zone{{
+			Name: "internal.",
+			Records: []types.Record{{
+				Name: "corp",
+				MX: []types.MXRecord{
+					{Preference: 20, Exchange: "mail2.internal."},
+					{Preference: 10, Exchange: "mail1.internal."},
+					{Preference: 30, Exchange: "mail3.internal."},
+				},
+			}},
+		}}, append(opts, WithUpstream("192.168.1.1"), WithExchanger(exchanger))...)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		return server
+	}
+
+	ask := func(server *Server, name string, qtype uint16) []string {
+		return answerOrder(server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, qtype)))
+	}
+
+	ginkgo.It("should keep the order as is by default", func() {
+		server := newServer()
+
+		for i := 0; i < 3; i++ {
+			gomega.Expect(ask(server, "corp.internal.", dns.TypeMX)).To(gomega.Equal([]string{
+				"20 mail2.internal.", "10 mail1.internal.", "30 mail3.internal.",
+			}))
+			gomega.Expect(ask(server, "www.example.com.", dns.TypeA)).To(gomega.Equal([]string{
+				"target.example.com.", "10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.2",
+			}))
+		}
+	})
+
+	ginkgo.It("should sort the records", func() {
+		server := newServer(WithAnswerOrder(OrderSorted))
+
+		for i := 0; i < 3; i++ {
+			gomega.Expect(ask(server, "corp.internal.", dns.TypeMX)).To(gomega.Equal([]string{
+				"10 mail1.internal.", "20 mail2.internal.", "30 mail3.internal.",
+			}))
+			gomega.Expect(ask(server, "www.example.com.", dns.TypeA)).To(gomega.Equal([]string{
+				"target.example.com.", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4",
+			}))
+		}
+	})
+
+	ginkgo.It("should shuffle the records and keep the CNAME first", func() {
+		server := newServer(WithAnswerOrder(OrderShuffled), WithRandomSeed(1))
+
+		orders := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			order := ask(server, "www.example.com.", dns.TypeA)
+			gomega.Expect(order[0]).To(gomega.Equal("target.example.com."))
+			gomega.Expect(order).To(gomega.ConsistOf("target.example.com.", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"))
+			orders[order[1]] = true
+		}
+		gomega.Expect(orders).To(gomega.HaveLen(4))
+	})
+})
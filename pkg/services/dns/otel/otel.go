@@ -0,0 +1,41 @@
+// Package otel records the traces of the DNS server with OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer returns a tracer for dns.WithTracer recording its spans with
+// tracer. The "error" attribute also sets the status of the span.
+func NewTracer(tracer trace.Tracer) dns.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, dns.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+	if key == "error" {
+		s.span.SetStatus(codes.Error, value)
+	}
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,79 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSuite(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "gvisor-tap-vsock dns otel suite")
+}
+
+// recordingTracer keeps the spans it starts.
+type recordingTracer struct {
+	noop.Tracer
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordingSpan{name: name, attributes: map[attribute.Key]string{}}
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	noop.Span
+	name       string
+	attributes map[attribute.Key]string
+	status     codes.Code
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attributes[attr.Key] = attr.Value.AsString()
+	}
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *recordingSpan) End(_ ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+var _ = ginkgo.Describe("otel tracer", func() {
+	ginkgo.It("should record the spans with OpenTelemetry", func() {
+		recorder := &recordingTracer{}
+		tracer := NewTracer(recorder)
+
+		ctx, span := tracer.Start(context.Background(), "dns.query")
+		span.SetAttribute("dns.qname", "example.com.")
+		span.End()
+
+		gomega.Expect(trace.SpanFromContext(ctx)).To(gomega.BeIdenticalTo(recorder.spans[0]))
+		gomega.Expect(recorder.spans).To(gomega.HaveLen(1))
+		gomega.Expect(recorder.spans[0].name).To(gomega.Equal("dns.query"))
+		gomega.Expect(recorder.spans[0].attributes).To(gomega.Equal(map[attribute.Key]string{"dns.qname": "example.com."}))
+		gomega.Expect(recorder.spans[0].status).To(gomega.Equal(codes.Unset))
+		gomega.Expect(recorder.spans[0].ended).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should mark the spans with an error as failed", func() {
+		recorder := &recordingTracer{}
+		_, span := NewTracer(recorder).Start(context.Background(), "dns.upstream")
+		span.SetAttribute("error", "i/o timeout")
+
+		gomega.Expect(recorder.spans[0].attributes).To(gomega.HaveKeyWithValue(attribute.Key("error"), "i/o timeout"))
+		gomega.Expect(recorder.spans[0].status).To(gomega.Equal(codes.Error))
+	})
+})
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetQueryLog enables or disables the logging of the queries and of their
+// responses, at the info level.
+func (s *Server) SetQueryLog(enabled bool) {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreUint32(&s.handler.queryLog, value)
+}
+
+// QueryLog returns true if the queries are logged.
+func (s *Server) QueryLog() bool {
+	return s.handler.queryLogging()
+}
+
+func (h *dnsHandler) queryLogging() bool {
+	return atomic.LoadUint32(&h.queryLog) == 1
+}
+
+// logQuery logs r, received from client, and m, its response, when enabled.
+func (h *dnsHandler) logQuery(client net.Addr, r *dns.Msg, m *dns.Msg, source querySource, latency time.Duration) {
+	if !h.queryLogging() {
+		return
+	}
+	name, qtype := "", ""
+	if len(r.Question) > 0 {
+		name, qtype = h.redact(r.Question[0].Name), dns.TypeToString[r.Question[0].Qtype]
+	}
+	answeredBy := sourceNames[source]
+	if source == sourceUpstream {
+		answeredBy += " " + h.upstreamFor(r)
+	}
+	log.Infof("dns query from %v: %s %s: %s, %d answers, from %s in %s", client, name, qtype, dns.RcodeToString[m.Rcode], len(m.Answer), answeredBy, latency)
+}
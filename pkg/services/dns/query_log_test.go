@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ = ginkgo.Describe("dns query log", func() {
+	var (
+		server *Server
+		output bytes.Buffer
+		out    io.Writer
+		level  log.Level
+	)
+
+	ginkgo.BeforeEach(func() {
+		output.Reset()
+		out, level = log.StandardLogger().Out, log.GetLevel()
+		log.SetOutput(&output)
+		log.SetLevel(log.InfoLevel)
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithoutForwarding())
+	})
+
+	ginkgo.AfterEach(func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+	})
+
+	client := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.127.2"), Port: 40000}}
+
+	ginkgo.It("should not log the queries by default", func() {
+		server.handler.handleUDP(client, query("crc.internal.", dns.TypeA))
+
+		gomega.Expect(output.String()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should log the queries and their responses once enabled", func() {
+		server.SetQueryLog(true)
+		server.handler.handleUDP(client, query("crc.internal.", dns.TypeA))
+		server.handler.handleUDP(client, query("missing.internal.", dns.TypeAAAA))
+
+		gomega.Expect(output.String()).To(gomega.ContainSubstring("dns query from 192.168.127.2:40000: crc.internal. A: NOERROR, 1 answers, from local in "))
+		gomega.Expect(output.String()).To(gomega.ContainSubstring("dns query from 192.168.127.2:40000: missing.internal. AAAA: NXDOMAIN, 0 answers, from local in "))
+	})
+
+	ginkgo.It("should enable and disable the logging through the mux", func() {
+		put := func(body string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/query-log", strings.NewReader(body)))
+			return rec
+		}
+
+		gomega.Expect(put(`{"enabled": true}`).Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(server.QueryLog()).To(gomega.BeTrue())
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/query-log", nil))
+		gomega.Expect(rec.Body.String()).To(gomega.MatchJSON(`{"enabled": true}`))
+
+		gomega.Expect(put(`{"enabled": false}`).Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(server.QueryLog()).To(gomega.BeFalse())
+		gomega.Expect(put(`enabled`).Code).To(gomega.Equal(http.StatusBadRequest))
+
+		rec = httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query-log", nil))
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusMethodNotAllowed))
+	})
+})
@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimiter bounds the rate of the queries of each client with a token
+// bucket per IP address.
+type rateLimiter struct {
+	// queries per second, and queries allowed at once
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	lock    sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		clients: map[string]*tokenBucket{},
+	}
+}
+
+// allow returns false if client exceeded its rate, and takes a token
+// otherwise.
+func (l *rateLimiter) allow(client net.IP) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	key := client.String()
+	bucket, ok := l.clients[key]
+	if !ok {
+		l.prune(now)
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune forgets the clients whose bucket has refilled, they are no
+// different from new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// rateLimited answers r, sent by the client at addr, if the client exceeded
+// its rate: over UDP with a truncated response, so that the legitimate
+// clients retry over TCP, over TCP with REFUSED. It returns false if r must
+// be answered normally.
+func (h *dnsHandler) rateLimited(w dns.ResponseWriter, r *dns.Msg, overTCP bool) bool {
+	if h.rateLimiter == nil {
+		return false
+	}
+	client := remoteIP(w.RemoteAddr())
+	if client == nil || h.rateLimiter.allow(client) {
+		return false
+	}
+	atomic.AddUint64(&h.rateLimitedQueries, 1)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = h.forwarding
+	if overTCP {
+		m.Rcode = dns.RcodeRefused
+		addExtendedError(m, r, dns.ExtendedErrorCodeOther, "rate limited")
+	} else {
+		m.Truncated = true
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Error(err)
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"net"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns rate limiting", func() {
+	var (
+		server *Server
+		clock  *fakeClock
+	)
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithoutForwarding(), WithRateLimit(1, 2))
+		clock = &fakeClock{t: time.Now()}
+		server.handler.rateLimiter.now = clock.now
+	})
+
+	client := func(ip string) *fakeResponseWriter {
+		return &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}}
+	}
+
+	ginkgo.It("should truncate the UDP responses once a client exceeds its rate", func() {
+		for i := 0; i < 2; i++ {
+			w := client("192.168.127.2")
+			server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+			gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+		}
+
+		w := client("192.168.127.2")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Truncated).To(gomega.BeTrue())
+		gomega.Expect(w.msg.Answer).To(gomega.BeEmpty())
+		gomega.Expect(server.stats().RateLimited).To(gomega.Equal(uint64(1)))
+	})
+
+	ginkgo.It("should refuse the TCP queries once a client exceeds its rate", func() {
+		for i := 0; i < 2; i++ {
+			server.handler.handleTCP(client("192.168.127.2"), query("crc.internal.", dns.TypeA))
+		}
+
+		w := client("192.168.127.2")
+		server.handler.handleTCP(w, edns0Query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(extendedError(w.msg).InfoCode).To(gomega.Equal(dns.ExtendedErrorCodeOther))
+	})
+
+	ginkgo.It("should limit each client separately", func() {
+		for i := 0; i < 3; i++ {
+			server.handler.handleUDP(client("192.168.127.2"), query("crc.internal.", dns.TypeA))
+		}
+
+		w := client("192.168.127.3")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Truncated).To(gomega.BeFalse())
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should answer a client again once its bucket refilled", func() {
+		for i := 0; i < 3; i++ {
+			server.handler.handleUDP(client("192.168.127.2"), query("crc.internal.", dns.TypeA))
+		}
+		clock.advance(time.Second)
+
+		w := client("192.168.127.2")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Truncated).To(gomega.BeFalse())
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should forget the clients whose bucket refilled", func() {
+		server.handler.handleUDP(client("192.168.127.2"), query("crc.internal.", dns.TypeA))
+		clock.advance(2 * time.Second)
+		server.handler.handleUDP(client("192.168.127.3"), query("crc.internal.", dns.TypeA))
+
+		gomega.Expect(server.handler.rateLimiter.clients).To(gomega.HaveLen(1))
+		gomega.Expect(server.handler.rateLimiter.clients).To(gomega.HaveKey("192.168.127.3"))
+	})
+
+	ginkgo.It("should allow a second of queries without a burst", func() {
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithoutForwarding(), WithRateLimit(2.5, 0))
+		server.handler.rateLimiter.now = clock.now
+
+		for i := 0; i < 3; i++ {
+			w := client("192.168.127.2")
+			server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+			gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+		}
+
+		w := client("192.168.127.2")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Truncated).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should allow at least one query without a burst", func() {
+		server = newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithoutForwarding(), WithRateLimit(0.1, -1))
+		server.handler.rateLimiter.now = clock.now
+
+		w := client("192.168.127.2")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+
+		w = client("192.168.127.2")
+		server.handler.handleUDP(w, query("crc.internal.", dns.TypeA))
+		gomega.Expect(w.msg.Truncated).To(gomega.BeTrue())
+	})
+})
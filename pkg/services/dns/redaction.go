@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NameRedactor rewrites the query names before they are recorded in the
+// logs and the traces, to keep them private.
+type NameRedactor func(name string) string
+
+// HashNames replaces the names with their SHA-256 hash salted with salt. The
+// same name always gives the same hash, so that queries can be correlated.
+func HashNames(salt string) NameRedactor {
+	return func(name string) string {
+		sum := sha256.Sum256([]byte(salt + strings.ToLower(name)))
+		return hex.EncodeToString(sum[:])
+	}
+}
+
+// TruncateNames only keeps the last labels of the names, such as example.com.
+// for www.example.com. with 2 labels. The count of labels is fixed, which is
+// not the registrable domain under a public suffix of several labels:
+// www.example.co.uk. gives co.uk. with 2 labels. Less than 1 label redacts
+// the names entirely, as the root ".".
+func TruncateNames(labels int) NameRedactor {
+	return func(name string) string {
+		if labels < 1 {
+			return "."
+		}
+		indexes := dns.Split(name)
+		if len(indexes) <= labels {
+			return name
+		}
+		return name[indexes[len(indexes)-labels]:]
+	}
+}
+
+func noRedaction(name string) string {
+	return name
+}
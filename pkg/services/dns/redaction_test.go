@@ -0,0 +1,68 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ = ginkgo.Describe("dns name redaction", func() {
+	ginkgo.It("should not log the raw query names", func() {
+		var output bytes.Buffer
+		out, level := log.StandardLogger().Out, log.GetLevel()
+		log.SetOutput(&output)
+		log.SetLevel(log.DebugLevel)
+		defer func() {
+			log.SetOutput(out)
+			log.SetLevel(level)
+		}()
+		exchanger := &mockExchanger{respond: func(*dns.Msg) (*dns.Msg, error) {
+			return nil, errors.New("connection refused")
+		}}
+		server := newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithNameRedaction(HashNames("salt")))
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("secret.example.com.", dns.TypeA))
+
+		gomega.Expect(output.String()).To(gomega.ContainSubstring("connection refused"))
+		gomega.Expect(output.String()).To(gomega.ContainSubstring(HashNames("salt")("secret.example.com.")))
+		gomega.Expect(output.String()).NotTo(gomega.ContainSubstring("secret"))
+	})
+
+	ginkgo.It("should record the redacted query names in the traces", func() {
+		recorder := &spanRecorder{}
+		server := newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithTracer(recorder), WithNameRedaction(TruncateNames(1)), WithUpstream(unreachableUpstream))
+
+		server.handler.handleUDP(&fakeResponseWriter{}, query("secret.internal.", dns.TypeA))
+
+		gomega.Expect(recorder.spans[0].attributes).To(gomega.HaveKeyWithValue("dns.qname", "internal."))
+	})
+
+	ginkgo.It("should truncate names to their last labels", func() {
+		gomega.Expect(TruncateNames(2)("www.example.com.")).To(gomega.Equal("example.com."))
+		gomega.Expect(TruncateNames(2)("example.com.")).To(gomega.Equal("example.com."))
+		gomega.Expect(TruncateNames(2)("com.")).To(gomega.Equal("com."))
+		gomega.Expect(TruncateNames(2)("www.example.co.uk.")).To(gomega.Equal("co.uk."))
+	})
+
+	ginkgo.It("should redact names entirely with less than one label", func() {
+		for _, labels := range []int{0, -1} {
+			gomega.Expect(TruncateNames(labels)("www.example.com.")).To(gomega.Equal("."))
+			gomega.Expect(TruncateNames(labels)(".")).To(gomega.Equal("."))
+		}
+	})
+
+	ginkgo.It("should hash names with the salt", func() {
+		gomega.Expect(HashNames("a")("example.com.")).To(gomega.Equal(HashNames("a")("Example.com.")))
+		gomega.Expect(HashNames("a")("example.com.")).NotTo(gomega.Equal(HashNames("b")("example.com.")))
+	})
+})
@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+const (
+	// the regexps of the records are bounded, so that a pathological pattern
+	// can't exhaust the memory of the server
+	maxRegexpLength = 256
+	// maxRegexpInsts bounds the compiled program, which grows with the repetitions
+	maxRegexpInsts = 2000
+	// maxCachedRegexps bounds the compiled regexps kept for reuse
+	maxCachedRegexps = 1024
+)
+
+var (
+	regexpCache     = map[string]*regexp.Regexp{}
+	regexpCacheLock sync.Mutex
+)
+
+// checkRegexp returns an error if expr is invalid or too complex to be the
+// regexp of a record.
+func checkRegexp(expr string) error {
+	if len(expr) > maxRegexpLength {
+		return fmt.Errorf("regexp is %d bytes long, over the limit of %d", len(expr), maxRegexpLength)
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("invalid regexp %q: %w", expr, err)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return fmt.Errorf("invalid regexp %q: %w", expr, err)
+	}
+	if len(prog.Inst) > maxRegexpInsts {
+		return fmt.Errorf("regexp %q is too complex: %d instructions, over the limit of %d", expr, len(prog.Inst), maxRegexpInsts)
+	}
+	return nil
+}
+
+// compileRegexp compiles expr once checked, reusing the regexp compiled
+// for the same expression if any.
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	regexpCacheLock.Lock()
+	re, ok := regexpCache[expr]
+	regexpCacheLock.Unlock()
+	if ok {
+		return re, nil
+	}
+	if err := checkRegexp(expr); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp %q: %w", expr, err)
+	}
+	regexpCacheLock.Lock()
+	defer regexpCacheLock.Unlock()
+	if len(regexpCache) < maxCachedRegexps {
+		regexpCache[expr] = re
+	}
+	return re, nil
+}
+
+// zoneJSON decodes a zone with compileRegexp instead of compiling the
+// regexps of its records unchecked: the fields of zoneJSON and recordJSON
+// take precedence over the embedded ones with the same name.
+type zoneJSON struct {
+	types.Zone
+	Records []recordJSON
+}
+
+type recordJSON struct {
+	types.Record
+	Regexp *string
+}
+
+func (z zoneJSON) zone() (types.Zone, error) {
+	zone := z.Zone
+	zone.Records = nil
+	if z.Records != nil {
+		zone.Records = make([]types.Record, 0, len(z.Records))
+	}
+	for _, r := range z.Records {
+		record := r.Record
+		if r.Regexp != nil {
+			re, err := compileRegexp(*r.Regexp)
+			if err != nil {
+				return types.Zone{}, err
+			}
+			record.Regexp = re
+		}
+		zone.Records = append(zone.Records, record)
+	}
+	return zone, nil
+}
+
+// zoneJSONOf mirrors zone with the regexps of its records as strings, which
+// encoding/json can't do with regexp.Regexp before Go 1.21.
+func zoneJSONOf(zone types.Zone) zoneJSON {
+	z := zoneJSON{Zone: zone}
+	if zone.Records != nil {
+		z.Records = make([]recordJSON, 0, len(zone.Records))
+	}
+	for _, record := range zone.Records {
+		r := recordJSON{Record: record}
+		if record.Regexp != nil {
+			expr := record.Regexp.String()
+			r.Regexp = &expr
+		}
+		z.Records = append(z.Records, r)
+	}
+	return z
+}
+
+func zonesJSONOf(zones []types.Zone) []zoneJSON {
+	zs := make([]zoneJSON, 0, len(zones))
+	for _, zone := range zones {
+		zs = append(zs, zoneJSONOf(zone))
+	}
+	return zs
+}
+
+// decodeZone reads a zone in JSON from r.
+func decodeZone(r io.Reader) (types.Zone, error) {
+	var z zoneJSON
+	if err := json.NewDecoder(r).Decode(&z); err != nil {
+		return types.Zone{}, err
+	}
+	return z.zone()
+}
+
+// decodeZones reads a list of zones in JSON from r.
+func decodeZones(r io.Reader) ([]types.Zone, error) {
+	var zs []zoneJSON
+	if err := json.NewDecoder(r).Decode(&zs); err != nil {
+		return nil, err
+	}
+	return zonesOf(zs)
+}
+
+func zonesOf(zs []zoneJSON) ([]types.Zone, error) {
+	zones := make([]types.Zone, 0, len(zs))
+	for i, z := range zs {
+		zone, err := z.zone()
+		if err != nil {
+			return nil, fmt.Errorf("zone %d: %w", i, err)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
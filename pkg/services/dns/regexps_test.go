@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns record regexps", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+	})
+
+	post := func(path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Mux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	ginkgo.It("should accept a normal pattern", func() {
+		rec := post("/add", `{"Name": "internal.", "Records": [{"Regexp": "^(web|api)-[0-9]+$", "IP": "192.168.127.2"}]}`)
+
+		gomega.Expect(rec.Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(server.Zones()[0].Records[0].Regexp.MatchString("web-1")).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should reuse the regexp compiled for the same pattern", func() {
+		gomega.Expect(post("/add", `{"Name": "internal.", "Records": [{"Regexp": "^reused-[a-z]+$", "IP": "192.168.127.2"}]}`).Code).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(post("/add", `{"Name": "testing.", "Records": [{"Regexp": "^reused-[a-z]+$", "IP": "192.168.127.3"}]}`).Code).To(gomega.Equal(http.StatusOK))
+
+		zones := server.Zones()
+		gomega.Expect(zones).To(gomega.HaveLen(2))
+		gomega.Expect(zones[0].Records[0].Regexp).To(gomega.BeIdenticalTo(zones[1].Records[0].Regexp))
+	})
+
+	for description, pattern := range map[string]string{
+		"too long":    strings.Repeat("a", maxRegexpLength+1),
+		"too complex": "(a{1,100}){1,10}(b{1,100}){1,10}",
+	} {
+		pattern := pattern
+		ginkgo.It("should reject a pattern "+description, func() {
+			rec := post("/add", `{"Name": "internal.", "Records": [{"Regexp": "`+pattern+`", "IP": "192.168.127.2"}]}`)
+
+			gomega.Expect(rec.Code).To(gomega.Equal(http.StatusBadRequest))
+			gomega.Expect(rec.Body.String()).To(gomega.ContainSubstring("over the limit"))
+			gomega.Expect(server.Zones()).To(gomega.BeEmpty())
+		})
+	}
+
+	ginkgo.It("should reject a pattern too complex added programmatically", func() {
+		err := server.AddZone(types.Zone{Name: "internal.", Records: []types.Record{
+			{Regexp: regexp.MustCompile("(a{1,100}){1,10}(b{1,100}){1,10}"), IP: []byte{192, 168, 127, 2}},
+		}})
+
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("too complex")))
+	})
+})
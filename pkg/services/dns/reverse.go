@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reverseIP returns the address of name, a reverse name such as
+// "2.127.168.192.in-addr.arpa." or a nibble "ip6.arpa." name, or nil if
+// name is not the one of a whole address.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+			octets[i], octets[j] = octets[j], octets[i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// addZonePTR answers the PTR queries for the addresses of the records of the
+// local zones with their names. It returns false if no record has the
+// address. The records matched by a regexp or a glob have no name to answer,
+// neither have the default IPs of the zones.
+func (h *dnsHandler) addZonePTR(m *dns.Msg, q dns.Question) bool {
+	if q.Qclass != dns.ClassINET || q.Qtype != dns.TypePTR {
+		return false
+	}
+	ip := reverseIP(q.Name)
+	if ip == nil {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, zone := range h.snapshot() {
+		for _, record := range zone.Records {
+			if record.Name == "" || (!ip.Equal(record.IP) && !ip.Equal(record.IPv6)) {
+				continue
+			}
+			name := dns.Fqdn(record.Name + "." + zone.Name)
+			if seen[strings.ToLower(name)] {
+				continue
+			}
+			seen[strings.ToLower(name)] = true
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    h.recordTTL(zone, record),
+				},
+				Ptr: name,
+			})
+		}
+	}
+	return len(m.Answer) > 0
+}
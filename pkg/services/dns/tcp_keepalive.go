@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultTCPIdleTimeout is how long the dns package keeps a connection open
+// waiting for another query when TCPOptions.IdleTimeout is zero.
+const defaultTCPIdleTimeout = 8 * time.Second
+
+// tcpKeepaliveWriter tells the clients asking with the edns-tcp-keepalive
+// option how long their connection stays open between queries (RFC 7828).
+type tcpKeepaliveWriter struct {
+	dns.ResponseWriter
+	query       *dns.Msg
+	idleTimeout time.Duration
+}
+
+func (w tcpKeepaliveWriter) WriteMsg(m *dns.Msg) error {
+	addTCPKeepalive(m, w.query, w.idleTimeout)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// addTCPKeepalive adds the edns-tcp-keepalive option with idleTimeout to m,
+// the response to r over TCP, if r has the option. The option of the
+// upstream nameserver, if any, is replaced.
+func addTCPKeepalive(m *dns.Msg, r *dns.Msg, idleTimeout time.Duration) {
+	reqOpt := r.IsEdns0()
+	if !hasEDNS0Option(reqOpt, dns.EDNS0TCPKEEPALIVE) {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, reqOpt.Do())
+		opt = m.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	// in units of 100 milliseconds, a timeout of 0 can't be encoded
+	timeout := math.Min(math.Max(float64(idleTimeout/(100*time.Millisecond)), 1), math.MaxUint16)
+	opt.Option = append(options, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout)})
+}
+
+// hasEDNS0Option returns true if opt, which may be nil, has the option code.
+func hasEDNS0Option(opt *dns.OPT, code uint16) bool {
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// keepAliveConn is a connection with TCP keepalive probes, such as
+// net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// keepAliveListener sets the TCP keepalive probes of the connections it
+// accepts, every period, or disables them if period is negative.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if conn, ok := conn.(keepAliveConn); ok {
+		if l.period < 0 {
+			_ = conn.SetKeepAlive(false)
+		} else {
+			_ = conn.SetKeepAlive(true)
+			_ = conn.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,27 @@
+package dns
+
+import "context"
+
+// Tracer creates the spans recorded while handling queries. The otel
+// subpackage adapts the OpenTelemetry tracers.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation.
+type Span interface {
+	SetAttribute(key string, value string)
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(_ string, _ string) {}
+
+func (noopSpan) End() {}
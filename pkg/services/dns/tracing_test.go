@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]string
+	ended      bool
+}
+
+type spanKey struct{}
+
+// spanRecorder is an in-memory tracer.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	span := &recordedSpan{name: name, attributes: make(map[string]string)}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), &recorderSpan{recorder: r, span: span}
+}
+
+type recorderSpan struct {
+	recorder *spanRecorder
+	span     *recordedSpan
+}
+
+func (s *recorderSpan) SetAttribute(key string, value string) {
+	s.recorder.lock.Lock()
+	defer s.recorder.lock.Unlock()
+	s.span.attributes[key] = value
+}
+
+func (s *recorderSpan) End() {
+	s.recorder.lock.Lock()
+	defer s.recorder.lock.Unlock()
+	s.span.ended = true
+}
+
+var _ = ginkgo.Describe("dns tracing", func() {
+	ginkgo.It("should trace a forwarded query", func() {
+		upstream := startFakeUpstream("10.0.0.1", 60)
+		defer upstream.stop()
+		recorder := &spanRecorder{}
+		server := newTestServer([]types.Zone{}, WithTracer(recorder), WithUpstream(upstream.addr()))
+
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.127.2"), Port: 4242}}
+		server.handler.handleUDP(w, query("example.com.", dns.TypeA))
+
+		gomega.Expect(w.msg.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(recorder.spans).To(gomega.HaveLen(3))
+		root, local, forwarded := recorder.spans[0], recorder.spans[1], recorder.spans[2]
+		gomega.Expect(root.name).To(gomega.Equal("dns.query"))
+		gomega.Expect(root.parent).To(gomega.BeEmpty())
+		gomega.Expect(root.attributes).To(gomega.Equal(map[string]string{
+			"dns.qname":      "example.com.",
+			"dns.qtype":      "A",
+			"client.address": "192.168.127.2:4242",
+			"dns.source":     "upstream",
+			"dns.rcode":      "NOERROR",
+		}))
+		gomega.Expect(local.name).To(gomega.Equal("dns.local"))
+		gomega.Expect(local.parent).To(gomega.Equal("dns.query"))
+		gomega.Expect(local.attributes).To(gomega.HaveKeyWithValue("dns.local.answered", "false"))
+		gomega.Expect(forwarded.name).To(gomega.Equal("dns.upstream"))
+		gomega.Expect(forwarded.parent).To(gomega.Equal("dns.query"))
+		gomega.Expect(forwarded.attributes).To(gomega.HaveKeyWithValue("dns.upstream", upstream.addr()))
+		for _, span := range recorder.spans {
+			gomega.Expect(span.ended).To(gomega.BeTrue())
+		}
+	})
+
+	ginkgo.It("should trace what answered a query", func() {
+		upstream := startFakeUpstream("10.0.0.1", 60)
+		defer upstream.stop()
+		recorder := &spanRecorder{}
+		server := newTestServer([]types.Zone{{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2")}},
+		}}, WithTracer(recorder), WithUpstream(upstream.addr()))
+
+		for _, name := range []string{"crc.internal.", "example.com.", "example.com."} {
+			server.handler.handleUDP(&fakeResponseWriter{}, query(name, dns.TypeA))
+		}
+
+		var sources []string
+		for _, span := range recorder.spans {
+			if span.name == "dns.query" {
+				sources = append(sources, span.attributes["dns.source"])
+			}
+		}
+		gomega.Expect(sources).To(gomega.Equal([]string{"local", "upstream", "cache"}))
+	})
+})
@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseUpstream returns the option forwarding the queries to upstream, a
+// nameserver given as "host[:port]" for plain DNS, as
+// "tls://host[:port][#name]" for DNS over TLS with its certificate verified
+// for name, the host by default, or as an https:// URL for DNS over HTTPS.
+func ParseUpstream(upstream string) (Option, error) {
+	if strings.HasPrefix(upstream, "https://") {
+		return WithHTTPSUpstream(upstream, nil), nil
+	}
+	address, ok := strings.CutPrefix(upstream, "tls://")
+	if !ok {
+		if strings.Contains(upstream, "://") {
+			return nil, fmt.Errorf("unsupported upstream %q, only plain DNS, tls:// and https:// are supported", upstream)
+		}
+		return WithUpstream(upstream), nil
+	}
+	address, serverName, _ := strings.Cut(address, "#")
+	if address == "" {
+		return nil, fmt.Errorf("upstream %q has no host", upstream)
+	}
+	return WithTLSUpstream(address, &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}), nil
+}
+
+// WatchUpstream refreshes the upstream nameservers whenever the ones
+// configured on the host change, such as when a VPN goes up or down, until
+// ctx is done. The cached answers are forgotten then, as they may not be
+// valid on the new network. It replaces the upstreams set by the options.
+func (s *Server) WatchUpstream(ctx context.Context) error {
+	return watchSystemConfig(ctx, s.systemConfigChanged)
+}
+
+func (s *Server) systemConfigChanged() {
+	previous := s.handler.upstreams()
+	if err := s.RefreshUpstream(); err != nil {
+		log.Errorf("cannot refresh the upstream nameservers: %v", err)
+		return
+	}
+	if current := s.handler.upstreams(); !equalStrings(current, previous) {
+		log.Infof("upstream nameservers changed to %v", current)
+		s.FlushCache("")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamDownTime is how long a nameserver which failed to answer is only
+// tried after the others.
+const upstreamDownTime = 30 * time.Second
+
+// upstreamHealth tracks the failures of an upstream nameserver.
+type upstreamHealth struct {
+	// consecutive failures, reset by an answer
+	failures uint64
+	// the nameserver is tried after the others until then
+	downUntil time.Time
+}
+
+func (h *dnsHandler) setUpstreams(nameservers []string) {
+	h.nameserverLock.Lock()
+	defer h.nameserverLock.Unlock()
+	// the nameservers kept keep their health
+	health := make(map[string]*upstreamHealth, len(nameservers))
+	for _, nameserver := range nameservers {
+		if previous, ok := h.upstreamHealth[nameserver]; ok {
+			health[nameserver] = previous
+		} else {
+			health[nameserver] = &upstreamHealth{}
+		}
+	}
+	h.nameservers = nameservers
+	h.upstreamHealth = health
+}
+
+// upstream returns the address of the upstream nameserver tried first.
+func (h *dnsHandler) upstream() string {
+	if nameservers := h.upstreamOrder(); len(nameservers) > 0 {
+		return nameservers[0]
+	}
+	return ""
+}
+
+// upstreamFor returns the address of the nameserver r is sent to first.
+func (h *dnsHandler) upstreamFor(r *dns.Msg) string {
+	if forwarder := h.forwarder(r.Question[0].Name); forwarder != "" {
+		return forwarder
+	}
+	return h.upstream()
+}
+
+// forwarder returns the address of the forwarder of the local zone of name,
+// empty if it has none or if name is in no local zone.
+func (h *dnsHandler) forwarder(name string) string {
+	name = asciiName(name)
+	for _, zone := range h.snapshot() {
+		if _, ok := inZone(name, zone.Name); ok {
+			return zone.Forwarder
+		}
+	}
+	return ""
+}
+
+// upstreams returns the addresses of the upstream nameservers, in order of
+// preference.
+func (h *dnsHandler) upstreams() []string {
+	h.nameserverLock.RLock()
+	defer h.nameserverLock.RUnlock()
+	return append([]string(nil), h.nameservers...)
+}
+
+// upstreamOrder returns the upstream nameservers in the order they are tried:
+// the ones which are up in order of preference, then the ones which are down.
+func (h *dnsHandler) upstreamOrder() []string {
+	h.nameserverLock.RLock()
+	defer h.nameserverLock.RUnlock()
+	now := time.Now()
+	up := make([]string, 0, len(h.nameservers))
+	var down []string
+	for _, nameserver := range h.nameservers {
+		if health := h.upstreamHealth[nameserver]; health != nil && now.Before(health.downUntil) {
+			down = append(down, nameserver)
+		} else {
+			up = append(up, nameserver)
+		}
+	}
+	return append(up, down...)
+}
+
+// reportUpstream records the outcome of an exchange with nameserver, err
+// being nil if it answered.
+func (h *dnsHandler) reportUpstream(nameserver string, err error) {
+	h.nameserverLock.Lock()
+	defer h.nameserverLock.Unlock()
+	health, ok := h.upstreamHealth[nameserver]
+	if !ok {
+		// replaced in the meantime
+		return
+	}
+	if err == nil {
+		health.failures = 0
+		health.downUntil = time.Time{}
+		return
+	}
+	health.failures++
+	health.downUntil = time.Now().Add(upstreamDownTime)
+}
+
+func (h *dnsHandler) upstreamStatuses() []upstreamStatus {
+	h.nameserverLock.RLock()
+	defer h.nameserverLock.RUnlock()
+	now := time.Now()
+	statuses := make([]upstreamStatus, 0, len(h.nameservers))
+	for _, nameserver := range h.nameservers {
+		status := upstreamStatus{Address: nameserver, Up: true}
+		if health := h.upstreamHealth[nameserver]; health != nil {
+			status.Up = !now.Before(health.downUntil)
+			status.Failures = health.failures
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
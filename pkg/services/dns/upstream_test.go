@@ -0,0 +1,666 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns upstream", func() {
+	var (
+		server   *Server
+		upstream *fakeUpstream
+	)
+
+	ginkgo.BeforeEach(func() {
+		upstream = startFakeUpstream("10.0.0.1", 60)
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()))
+	})
+
+	ginkgo.AfterEach(func() {
+		upstream.stop()
+	})
+
+	ginkgo.It("should stop waiting for a slow upstream when the context is cancelled", func() {
+		upstream.setDelay(2 * time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := server.handler.exchange(ctx, server.handler.udpClient, query("example.com.", dns.TypeA))
+
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+	})
+
+	ginkgo.It("should cancel upstream queries when the server context is cancelled", func() {
+		upstream.setDelay(2 * time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		server = newTestServer([]types.Zone{}, WithContext(ctx), WithUpstream(upstream.addr()))
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		m := server.handler.addAnswers(server.handler.ctx, server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+	})
+
+	ginkgo.It("should share the upstream exchange between identical concurrent queries", func() {
+		upstream.setDelay(200 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		answers := make(chan *dns.Msg, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := "example.com."
+				if i%2 == 0 {
+					name = "EXAMPLE.com."
+				}
+				answers <- server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			}(i)
+		}
+		wg.Wait()
+		close(answers)
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+		for m := range answers {
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		}
+	})
+
+	ginkgo.It("should not share a truncated upstream answer with a query over TCP", func() {
+		udpExchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			time.Sleep(200 * time.Millisecond)
+			resp := new(dns.Msg)
+			resp.SetReply(m)
+			resp.Truncated = true
+			return resp, nil
+		}}
+		tcpExchanger := &mockExchanger{respond: answerA("10.0.0.1", 60)}
+		server.handler.udpClient = udpExchanger
+		server.handler.tcpClient = tcpExchanger
+
+		overUDP := make(chan *dns.Msg, 1)
+		go func() {
+			overUDP <- server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		}()
+		gomega.Eventually(udpExchanger.queryCount).Should(gomega.Equal(1))
+		m := server.handler.addAnswers(context.Background(), server.handler.tcpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Truncated).To(gomega.BeFalse())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(tcpExchanger.queryCount()).To(gomega.Equal(1))
+		gomega.Expect((<-overUDP).Truncated).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should not share the upstream exchange between different queries", func() {
+		upstream.setDelay(100 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeMX} {
+			wg.Add(1)
+			go func(qtype uint16) {
+				defer wg.Done()
+				server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", qtype))
+			}(qtype)
+		}
+		wg.Wait()
+
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should rewrite the answers made of bogus addresses to NXDOMAIN", func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()), WithBogusNXDomain(net.ParseIP("10.0.0.1")))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("missing.example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(m.Answer).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should keep the answers with other addresses than the bogus ones", func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()), WithBogusNXDomain(net.ParseIP("10.0.0.2")))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should forward the next queries to the upstream set at runtime", func() {
+		other := startFakeUpstream("10.0.0.2", 60)
+		defer other.stop()
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("before.example.com.", dns.TypeA))
+		server.SetUpstream(other.addr())
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("after.example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.2"))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+		gomega.Expect(other.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should forward the next queries to the upstream discovered again", func() {
+		other := startFakeUpstream("10.0.0.2", 60)
+		defer other.stop()
+		server.discoverUpstream = func() ([]string, error) {
+			return []string{other.addr()}, nil
+		}
+
+		gomega.Expect(server.RefreshUpstream()).To(gomega.Succeed())
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.2"))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should discover all the upstreams of the host", func() {
+		server.discoverUpstream = func() ([]string, error) {
+			return []string{"192.168.1.1:53", "192.168.1.2:53"}, nil
+		}
+
+		gomega.Expect(server.RefreshUpstream()).To(gomega.Succeed())
+		gomega.Expect(server.handler.upstreams()).To(gomega.Equal([]string{"192.168.1.1:53", "192.168.1.2:53"}))
+	})
+
+	ginkgo.It("should forget the cached answers when the upstreams of the host change", func() {
+		discovered := []string{upstream.addr()}
+		server.discoverUpstream = func() ([]string, error) {
+			return discovered, nil
+		}
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		server.systemConfigChanged()
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+
+		other := startFakeUpstream("10.0.0.2", 60)
+		defer other.stop()
+		discovered = []string{other.addr()}
+		server.systemConfigChanged()
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.2"))
+		gomega.Expect(other.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should forward to the upstream given to New", func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(upstream.addr()))
+		gomega.Expect(server.handler.nameservers).To(gomega.Equal([]string{upstream.addr()}))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should default the port of the upstream given to New", func() {
+		server = newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"))
+		gomega.Expect(server.handler.nameservers).To(gomega.Equal([]string{"192.168.1.1:53"}))
+
+		server = newTestServer([]types.Zone{}, WithUpstream("fd00::1"))
+		gomega.Expect(server.handler.nameservers).To(gomega.Equal([]string{"[fd00::1]:53"}))
+	})
+
+	ginkgo.It("should fail over to the next upstream when one doesn't answer", func() {
+		down := startFakeUpstream("10.0.0.3", 60)
+		down.stop()
+		server = newTestServer([]types.Zone{}, WithUpstreams(down.addr(), upstream.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+		gomega.Expect(server.handler.upstreamStatuses()).To(gomega.Equal([]upstreamStatus{
+			{Address: down.addr(), Up: false, Failures: 1},
+			{Address: upstream.addr(), Up: true},
+		}))
+	})
+
+	ginkgo.It("should try the upstreams which are down last", func() {
+		server = newTestServer([]types.Zone{}, WithUpstreams("192.168.1.1", upstream.addr()))
+		server.handler.reportUpstream("192.168.1.1:53", errTooManyUpstreamQueries)
+
+		gomega.Expect(server.handler.upstreamOrder()).To(gomega.Equal([]string{upstream.addr(), "192.168.1.1:53"}))
+		gomega.Expect(server.handler.upstream()).To(gomega.Equal(upstream.addr()))
+
+		server.handler.reportUpstream("192.168.1.1:53", nil)
+		gomega.Expect(server.handler.upstreamOrder()).To(gomega.Equal([]string{"192.168.1.1:53", upstream.addr()}))
+	})
+
+	ginkgo.It("should keep the health of the upstreams kept by SetUpstreams", func() {
+		server = newTestServer([]types.Zone{}, WithUpstreams("192.168.1.1", "192.168.1.2"))
+		server.handler.reportUpstream("192.168.1.1:53", errTooManyUpstreamQueries)
+		server.handler.reportUpstream("192.168.1.2:53", errTooManyUpstreamQueries)
+
+		server.SetUpstreams("192.168.1.1", "192.168.1.3")
+
+		gomega.Expect(server.handler.upstreamStatuses()).To(gomega.Equal([]upstreamStatus{
+			{Address: "192.168.1.1:53", Up: false, Failures: 1},
+			{Address: "192.168.1.3:53", Up: true},
+		}))
+	})
+
+	ginkgo.It("should fail when all the upstreams fail", func() {
+		down := startFakeUpstream("10.0.0.3", 60)
+		down.stop()
+		server = newTestServer([]types.Zone{}, WithUpstreams(down.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+	})
+
+	ginkgo.It("should forward the names of a zone to its forwarder", func() {
+		forwarder := startFakeUpstream("10.1.0.1", 60)
+		defer forwarder.stop()
+		server = newTestServer([]types.Zone{{
+			Name:      "corp.example.com.",
+			Forwarder: forwarder.addr(),
+			Records: []types.Record{{
+				Name: "gateway",
+				IP:   net.ParseIP("192.168.127.1"),
+			}},
+		}}, WithUpstream(upstream.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("intranet.corp.example.com.", dns.TypeA))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.1.0.1"))
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("gateway.corp.example.com.", dns.TypeA))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.1"))
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+
+		gomega.Expect(forwarder.queryCount()).To(gomega.Equal(1))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should forward the names of a zone to its forwarder over plain DNS with a TLS or HTTPS upstream", func() {
+		forwarder := startFakeUpstream("10.1.0.1", 60)
+		defer forwarder.stop()
+		zones := []types.Zone{{Name: "corp.example.com.", Forwarder: forwarder.addr()}}
+		for _, upstream := range []Option{
+			WithTLSUpstream("127.0.0.1:1", nil),
+			WithHTTPSUpstream("https://127.0.0.1:1/dns-query", nil),
+		} {
+			var err error
+			server, err = New(nil, nil, zones, upstream)
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+			for _, dnsClient := range []Exchanger{server.handler.udpClient, server.handler.tcpClient} {
+				m := server.handler.addAnswers(context.Background(), dnsClient, nil, query("intranet.corp.example.com.", dns.TypeA))
+				gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+				gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.1.0.1"))
+			}
+		}
+		gomega.Expect(forwarder.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should default the port of the forwarder of a zone", func() {
+		server = newTestServer([]types.Zone{{Name: "corp.example.com.", Forwarder: "fd00::1"}}, WithUpstream(upstream.addr()))
+
+		gomega.Expect(server.handler.forwarder("intranet.corp.example.com.")).To(gomega.Equal("[fd00::1]:53"))
+		gomega.Expect(server.handler.forwarder("example.com.")).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should start without upstream nameservers on the host and pick them up later", func() {
+		var discovered []string
+		server, err := New(nil, nil, []types.Zone{}, func(s *Server) {
+			s.discoverUpstream = func() ([]string, error) {
+				if len(discovered) == 0 {
+					return nil, errors.New("no nameserver found")
+				}
+				return discovered, nil
+			}
+		})
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+
+		discovered = []string{upstream.addr()}
+		gomega.Expect(server.RefreshUpstream()).To(gomega.Succeed())
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should start without upstream nameservers on the host when not forwarding", func() {
+		noNameservers := func(s *Server) {
+			s.discoverUpstream = func() ([]string, error) {
+				return nil, errors.New("no nameserver found")
+			}
+		}
+
+		server, err := New(nil, nil, []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, noNameservers, WithoutForwarding())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should refuse names missing the local zones when not forwarding", func() {
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithoutForwarding(), WithUpstream(upstream.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should only set the recursion available flag when forwarding", func() {
+		zones := []types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}
+		for _, forwarding := range []bool{true, false} {
+			var opts []Option
+			if !forwarding {
+				opts = append(opts, WithoutForwarding())
+			}
+			server = newTestServer(zones, append(opts, WithUpstream(upstream.addr()))...)
+
+			for _, name := range []string{"crc.internal.", "example.com."} {
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+				gomega.Expect(m.RecursionAvailable).To(gomega.Equal(forwarding), name)
+			}
+		}
+	})
+
+	ginkgo.It("should answer the configured rcode to names missing the local zones when not forwarding", func() {
+		server = newTestServer([]types.Zone{}, WithoutForwarding(), WithMissRcode(dns.RcodeNameError), WithUpstream(upstream.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+	ginkgo.It("should not forward names under a local-only suffix", func() {
+		server = newTestServer([]types.Zone{{
+			Name: "infra.corp.",
+			Records: []types.Record{{
+				Name: "gitlab",
+				IP:   net.ParseIP("10.1.0.2"),
+			}},
+		}}, WithLocalOnly("corp"), WithUpstream(upstream.addr()))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("gitlab.infra.corp.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+
+		for _, name := range []string{"wiki.hr.corp.", "corp."} {
+			m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused), name)
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(1))
+	})
+	ginkgo.It("should answer NXDOMAIN to the names under a local-only suffix in any case", func() {
+		server = newTestServer([]types.Zone{}, WithLocalOnly("Corp", "café.lan"), WithMissRcode(dns.RcodeNameError), WithUpstream(upstream.addr()))
+
+		for _, name := range []string{"wiki.hr.corp.", "Wiki.HR.CORP.", "nas.xn--caf-dma.lan.", `NAS.CAF\195\169.lan.`} {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeNameError), name)
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+	ginkgo.It("should not forward queries without recursion desired", func() {
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithUpstream(upstream.addr()))
+
+		r := query("example.com.", dns.TypeA)
+		r.RecursionDesired = false
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(m.RecursionDesired).To(gomega.BeFalse())
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+
+		r = query("crc.internal.", dns.TypeA)
+		r.RecursionDesired = false
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, r)
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+	})
+	ginkgo.It("should clamp the TTLs of the forwarded answers", func() {
+		exchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			resp, _ := answerA("10.0.0.1", 0)(m)
+			huge, _ := answerA("10.0.0.2", 7*24*3600)(m)
+			resp.Answer = append(resp.Answer, huge.Answer...)
+			return resp, nil
+		}}
+		server = newTestServer([]types.Zone{{
+			Name:      "internal.",
+			DefaultIP: net.ParseIP("192.168.127.254"),
+		}}, WithUpstream("192.168.1.1"), WithExchanger(exchanger), WithTTLBounds(30, 3600), WithDefaultTTL(5))
+
+		for i := 0; i < 2; i++ {
+			m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+			gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+			gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(30)))
+			gomega.Expect(m.Answer[1].Header().Ttl).To(gomega.Equal(uint32(3600)))
+		}
+		// the 0 TTL was raised before caching
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("crc.internal.", dns.TypeA))
+		gomega.Expect(m.Answer[0].Header().Ttl).To(gomega.Equal(uint32(5)))
+	})
+	for description, malform := range map[string]func(resp *dns.Msg){
+		"a mismatched ID":      func(resp *dns.Msg) { resp.Id++ },
+		"no response flag":     func(resp *dns.Msg) { resp.Response = false },
+		"another question":     func(resp *dns.Msg) { resp.Question[0].Name = "example.org." },
+		"another type":         func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA },
+		"no question":          func(resp *dns.Msg) { resp.Question = nil },
+		"an unexpected opcode": func(resp *dns.Msg) { resp.Opcode = dns.OpcodeNotify },
+	} {
+		malform := malform
+		ginkgo.It("should answer SERVFAIL to an upstream response with "+description, func() {
+			exchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+				resp, _ := answerA("10.0.0.1", 60)(m)
+				malform(resp)
+				return resp, nil
+			}}
+			server = newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+
+			for i := 0; i < 2; i++ {
+				m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+				gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+				gomega.Expect(m.Answer).To(gomega.BeEmpty())
+				gomega.Expect(m.Question).To(gomega.Equal(query("example.com.", dns.TypeA).Question))
+				gomega.Expect(extendedError(m).InfoCode).To(gomega.Equal(dns.ExtendedErrorCodeInvalidData))
+			}
+			// the bogus response was not cached
+			gomega.Expect(exchanger.queryCount()).To(gomega.Equal(2))
+		})
+	}
+	ginkgo.It("should accept an upstream error without question", func() {
+		exchanger := &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg)
+			resp.SetRcode(m, dns.RcodeRefused)
+			resp.Question = nil
+			return resp, nil
+		}}
+		server = newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeRefused))
+		gomega.Expect(m.Question).To(gomega.HaveLen(1))
+	})
+	ginkgo.It("should forward the queries over TLS to a DoT upstream", func() {
+		tlsUpstream, roots := startDNSServerTLS(upstream.handle, "dns.test")
+		defer func() {
+			_ = tlsUpstream.Shutdown()
+		}()
+		server = newTestServer([]types.Zone{}, WithTLSUpstream(tlsUpstream.Listener.Addr().String(), &tls.Config{ServerName: "dns.test", RootCAs: roots, MinVersion: tls.VersionTLS12}))
+
+		for _, dnsClient := range []Exchanger{server.handler.udpClient, server.handler.tcpClient} {
+			m := server.handler.addAnswers(context.Background(), dnsClient, nil, query("example.com.", dns.TypeA))
+			gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeSuccess))
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal("10.0.0.1"))
+			server.FlushCache("")
+		}
+		gomega.Expect(upstream.queryCount()).To(gomega.Equal(2))
+	})
+	ginkgo.It("should not forward the queries to a DoT upstream with another name", func() {
+		tlsUpstream, roots := startDNSServerTLS(upstream.handle, "dns.test")
+		defer func() {
+			_ = tlsUpstream.Shutdown()
+		}()
+		server = newTestServer([]types.Zone{}, WithTLSUpstream(tlsUpstream.Listener.Addr().String(), &tls.Config{ServerName: "other.test", RootCAs: roots, MinVersion: tls.VersionTLS12}))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(m.Rcode).To(gomega.Equal(dns.RcodeServerFailure))
+		gomega.Expect(upstream.queryCount()).To(gomega.BeZero())
+	})
+	ginkgo.It("should parse the plain and TLS upstreams", func() {
+		for upstream, expected := range map[string]string{
+			"192.168.1.1":                       "192.168.1.1:53",
+			"192.168.1.1:5353":                  "192.168.1.1:5353",
+			"tls://1.1.1.1#cloudflare-dns.com":  "1.1.1.1:853",
+			"tls://dns.example.com:8853":        "dns.example.com:8853",
+			"https://dns.example.com/dns-query": "https://dns.example.com/dns-query",
+		} {
+			opt, err := ParseUpstream(upstream)
+			gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+			server = newTestServer([]types.Zone{}, opt)
+			gomega.Expect(server.handler.upstream()).To(gomega.Equal(expected))
+		}
+		opt, _ := ParseUpstream("tls://dns.example.com:8853")
+		server = newTestServer([]types.Zone{}, opt)
+		pooled, ok := server.handler.udpClient.(*pooledClient)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(pooled.Net).To(gomega.Equal("tcp-tls"))
+		gomega.Expect(pooled.TLSConfig.ServerName).To(gomega.Equal("dns.example.com"))
+
+		for _, upstream := range []string{"quic://dns.example.com", "tls://#dns.example.com"} {
+			_, err := ParseUpstream(upstream)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		}
+	})
+	ginkgo.It("should forward the queries of UDP clients over TCP in TCP upstream mode", func() {
+		var lock sync.Mutex
+		networks := map[string]int{}
+		tcpUpstream := startDNSServerTCP(func(w dns.ResponseWriter, r *dns.Msg) {
+			lock.Lock()
+			networks[w.RemoteAddr().Network()]++
+			lock.Unlock()
+			m := new(dns.Msg)
+			m.SetReply(r)
+			for i := 0; i < 50; i++ {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, byte(i)),
+				})
+			}
+			_ = w.WriteMsg(m)
+		})
+		defer func() {
+			_ = tcpUpstream.Shutdown()
+		}()
+		server = newTestServer([]types.Zone{}, WithUpstream(tcpUpstream.Listener.Addr().String()), WithTCPUpstream())
+
+		w := &fakeResponseWriter{}
+		server.handler.handleUDP(w, query("example.com.", dns.TypeA))
+		server.handler.handleTCP(&fakeResponseWriter{}, query("example.org.", dns.TypeA))
+
+		lock.Lock()
+		defer lock.Unlock()
+		gomega.Expect(networks).To(gomega.Equal(map[string]int{"tcp": 2}))
+		// 50 answers don't fit in 512 bytes
+		gomega.Expect(w.msg.Truncated).To(gomega.BeTrue())
+		gomega.Expect(w.msg.Len()).To(gomega.BeNumerically("<=", dns.MinMsgSize))
+	})
+})
+
+var _ = ginkgo.Describe("dns DNSSEC passthrough", func() {
+	var (
+		server    *Server
+		exchanger *mockExchanger
+	)
+
+	// the upstream validates, and signs the answers of the queries with the DO bit
+	ginkgo.BeforeEach(func() {
+		exchanger = &mockExchanger{respond: func(m *dns.Msg) (*dns.Msg, error) {
+			resp, err := answerA("10.0.0.1", 60)(m)
+			resp.AuthenticatedData = true
+			if opt := m.IsEdns0(); opt != nil {
+				resp.SetEdns0(opt.UDPSize(), opt.Do())
+				if opt.Do() {
+					resp.Answer = append(resp.Answer, &dns.RRSIG{
+						Hdr:         dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+						TypeCovered: dns.TypeA,
+						Algorithm:   dns.ECDSAP256SHA256,
+						Labels:      2,
+						OrigTtl:     60,
+						SignerName:  "example.com.",
+						Signature:   "c2lnbmF0dXJl",
+					})
+				}
+			}
+			return resp, err
+		}}
+		server = newTestServer([]types.Zone{}, WithUpstream("192.168.1.1"), WithExchanger(exchanger))
+	})
+
+	dnssecQuery := func() *dns.Msg {
+		r := query("example.com.", dns.TypeA)
+		r.SetEdns0(dns.DefaultMsgSize, true)
+		return r
+	}
+
+	ginkgo.It("should forward the DNSSEC records to the clients asking for them", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, dnssecQuery())
+
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(m.Answer[1]).To(gomega.BeAssignableToTypeOf(&dns.RRSIG{}))
+		gomega.Expect(m.IsEdns0().Do()).To(gomega.BeTrue())
+		gomega.Expect(m.AuthenticatedData).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should not serve the cached answers without DNSSEC records to the clients asking for them", func() {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.AuthenticatedData).To(gomega.BeFalse())
+
+		m = server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, dnssecQuery())
+		gomega.Expect(m.Answer).To(gomega.HaveLen(2))
+
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, dnssecQuery())
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should not give an OPT record to the clients not using EDNS0", func() {
+		server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, edns0Query("example.com.", dns.TypeA))
+
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query("example.com.", dns.TypeA))
+
+		gomega.Expect(exchanger.queryCount()).To(gomega.Equal(1))
+		gomega.Expect(m.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(m.IsEdns0()).To(gomega.BeNil())
+	})
+})
@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+)
+
+// validateZone checks that zone can be served before it gets added to the server.
+func validateZone(zone types.Zone) error {
+	if zone.Name == "" {
+		return errors.New("zone name is empty")
+	}
+	if len(zone.DefaultIP) == 0 && len(zone.DefaultIPv6) == 0 && len(zone.Records) == 0 && zone.Forwarder == "" {
+		return fmt.Errorf("zone %s has neither records nor a default IP or a forwarder", zone.Name)
+	}
+	if zone.Forwarder != "" {
+		host, _, err := net.SplitHostPort(zone.Forwarder)
+		if err != nil {
+			host = zone.Forwarder
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("zone %s: forwarder %q is not an IP address with an optional port", zone.Name, zone.Forwarder)
+		}
+	}
+	if len(zone.DefaultIPv6) > 0 {
+		if zone.DefaultIPv6.To4() != nil {
+			return fmt.Errorf("zone %s: default IPv6 %s is not an IPv6 address", zone.Name, zone.DefaultIPv6)
+		}
+		if len(zone.DefaultIP) > 0 && zone.DefaultIP.To4() == nil {
+			return fmt.Errorf("zone %s: default IP %s must be an IPv4 address along with a default IPv6", zone.Name, zone.DefaultIP)
+		}
+	}
+	if zone.SOA != nil && (zone.SOA.Ns == "" || zone.SOA.Mbox == "") {
+		return fmt.Errorf("zone %s: SOA needs a nameserver and a mailbox", zone.Name)
+	}
+	for _, ns := range zone.NS {
+		if ns == "" {
+			return fmt.Errorf("zone %s: nameserver has no host", zone.Name)
+		}
+	}
+	for i, record := range zone.Records {
+		if err := validateRecord(record); err != nil {
+			return fmt.Errorf("zone %s: record %d: %w", zone.Name, i, err)
+		}
+	}
+	return nil
+}
+
+func validateRecord(record types.Record) error {
+	if record.Name == "" && record.Regexp == nil && record.Glob == "" {
+		return errors.New("record has neither a name nor a regexp or glob")
+	}
+	if record.Regexp != nil {
+		if err := checkRegexp(record.Regexp.String()); err != nil {
+			return err
+		}
+	}
+	if _, err := path.Match(record.Glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", record.Glob, err)
+	}
+	if record.IP == nil && record.IPv6 == nil && len(record.MX) == 0 && len(record.SRV) == 0 && len(record.Views) == 0 && len(record.NS) == 0 &&
+		len(record.SVCB) == 0 && len(record.HTTPS) == 0 && record.CNAME == "" && len(record.TXT) == 0 {
+		return errors.New("record has no data, an IP, IPv6, MX, SRV, NS, SVCB, HTTPS, CNAME or TXT entry is needed")
+	}
+	if record.CNAME != "" {
+		if record.IP != nil || record.IPv6 != nil || len(record.MX) > 0 || len(record.SRV) > 0 || len(record.Views) > 0 || len(record.NS) > 0 ||
+			len(record.SVCB) > 0 || len(record.HTTPS) > 0 || len(record.TXT) > 0 || record.Weight > 0 {
+			return fmt.Errorf("CNAME %s excludes any other data of the record", record.CNAME)
+		}
+		if _, ok := dns.IsDomainName(record.CNAME); !ok {
+			return fmt.Errorf("invalid CNAME %q", record.CNAME)
+		}
+	}
+	if len(record.IPv6) > 0 {
+		if record.IPv6.To4() != nil {
+			return fmt.Errorf("IPv6 %s is not an IPv6 address", record.IPv6)
+		}
+		if len(record.IP) > 0 && record.IP.To4() == nil {
+			return fmt.Errorf("IP %s must be an IPv4 address along with an IPv6", record.IP)
+		}
+	}
+	if len(record.NS) > 0 && record.Name == "" {
+		return errors.New("delegation records need a name")
+	}
+	for _, ns := range record.NS {
+		if ns.Host == "" {
+			return errors.New("nameserver of delegation has no host")
+		}
+	}
+	for _, svcb := range append(record.SVCB[:len(record.SVCB):len(record.SVCB)], record.HTTPS...) {
+		for _, ip := range svcb.IPv4Hint {
+			if ip.To4() == nil {
+				return fmt.Errorf("ipv4hint %s is not an IPv4 address", ip)
+			}
+		}
+		for _, ip := range svcb.IPv6Hint {
+			if ip.To4() != nil {
+				return fmt.Errorf("ipv6hint %s is not an IPv6 address", ip)
+			}
+		}
+	}
+	for _, view := range record.Views {
+		if _, _, err := net.ParseCIDR(view.Subnet); err != nil {
+			return fmt.Errorf("invalid view: %w", err)
+		}
+		if view.IP == nil {
+			return fmt.Errorf("view %s has no IP", view.Subnet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// zoneConfig is a file of zones, in the JSON format of the HTTP API.
+type zoneConfig struct {
+	// Include are the files loaded before the zones of this file, relative
+	// to its directory unless absolute
+	Include []string
+	Zones   []zoneJSON
+}
+
+// LoadZoneConfigs reads the zones of the config files at paths and merges
+// them. The zones of a file override the ones with the same name of its
+// includes and of the files before it: their settings are replaced, and so
+// are the records with the same name, regexp or glob, the other records are
+// kept.
+func LoadZoneConfigs(paths ...string) ([]types.Zone, error) {
+	zones, _, err := loadZoneConfigs(paths)
+	return zones, err
+}
+
+// loadZoneConfigs is LoadZoneConfigs, also returning all the files read,
+// includes included.
+func loadZoneConfigs(paths []string) ([]types.Zone, []string, error) {
+	l := &zoneConfigLoader{loading: map[string]bool{}}
+	for _, path := range paths {
+		if err := l.load(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, zone := range l.zones {
+		if err := validateZone(zone); err != nil {
+			return nil, nil, err
+		}
+	}
+	return l.zones, l.files, nil
+}
+
+type zoneConfigLoader struct {
+	zones []types.Zone
+	files []string
+	// the files being loaded, to detect include cycles
+	loading map[string]bool
+}
+
+func (l *zoneConfigLoader) load(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.loading[path] {
+		return fmt.Errorf("zone config %s includes itself", path)
+	}
+	l.loading[path] = true
+	defer delete(l.loading, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	l.files = append(l.files, path)
+	var config zoneConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("cannot parse zone config %s: %w", path, err)
+	}
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := l.load(include); err != nil {
+			return err
+		}
+	}
+	zones, err := zonesOf(config.Zones)
+	if err != nil {
+		return fmt.Errorf("zone config %s: %w", path, err)
+	}
+	for _, zone := range zones {
+		l.zones = overlayZone(l.zones, normalizeZone(zone))
+	}
+	return nil
+}
+
+// overlayZone adds req to zones, replacing the zone of the same name but
+// keeping its records which req doesn't redefine.
+func overlayZone(zones []types.Zone, req types.Zone) []types.Zone {
+	for i, zone := range zones {
+		if zone.Name != req.Name {
+			continue
+		}
+		records := append([]types.Record(nil), req.Records...)
+		for _, record := range zone.Records {
+			if !redefined(req.Records, record) {
+				records = append(records, record)
+			}
+		}
+		req.Records = records
+		zones[i] = req
+		return zones
+	}
+	return append(zones, req)
+}
+
+// redefined returns true if one of records matches the same names as record.
+func redefined(records []types.Record, record types.Record) bool {
+	for _, other := range records {
+		if other.Name == record.Name && regexpString(other) == regexpString(record) && other.Glob == record.Glob {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchZoneConfigs serves the zones of the config files at paths, merged
+// as by LoadZoneConfigs, and reloads them when one of the files changes
+// until ctx is done. A reload replaces all the zones of the server,
+// including the ones added through the API. A file failing to load keeps
+// the current zones.
+func (s *Server) WatchZoneConfigs(ctx context.Context, paths ...string) error {
+	zones, files, err := loadZoneConfigs(paths)
+	if err != nil {
+		return err
+	}
+	if err := s.SetZones(zones); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	w := &zoneConfigWatcher{server: s, paths: paths, watcher: watcher, dirs: map[string]bool{}}
+	// watch the directories, the files may be replaced by a rename
+	if err := w.watchFiles(files); err != nil {
+		watcher.Close()
+		return err
+	}
+	go w.watch(ctx)
+	return nil
+}
+
+type zoneConfigWatcher struct {
+	server  *Server
+	paths   []string
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	// the files read by the last load
+	files map[string]bool
+}
+
+func (w *zoneConfigWatcher) watchFiles(files []string) error {
+	w.files = map[string]bool{}
+	for _, file := range files {
+		w.files[file] = true
+		dir := filepath.Dir(file)
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			return err
+		}
+		w.dirs[dir] = true
+	}
+	return nil
+}
+
+func (w *zoneConfigWatcher) watch(ctx context.Context) {
+	defer w.watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.files[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := w.reload(); err != nil {
+				log.Errorf("cannot reload zone configs: %v", err)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error watching zone configs: %v", err)
+		}
+	}
+}
+
+func (w *zoneConfigWatcher) reload() error {
+	zones, files, err := loadZoneConfigs(w.paths)
+	if err != nil {
+		return err
+	}
+	if err := w.server.SetZones(zones); err != nil {
+		return err
+	}
+	// the includes may have changed
+	return w.watchFiles(files)
+}
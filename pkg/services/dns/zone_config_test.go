@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns zone configs", func() {
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "dns-zones")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		gomega.Expect(os.WriteFile(path, []byte(content), 0600)).To(gomega.Succeed())
+		return path
+	}
+
+	resolve := func(server *Server, name string) string {
+		m := server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, dns.TypeA))
+		if len(m.Answer) == 0 {
+			return ""
+		}
+		return m.Answer[0].(*dns.A).A.String()
+	}
+
+	base := `{"Zones": [{"Name": "internal.", "Records": [
+		{"Name": "web", "IP": "192.168.127.2"},
+		{"Name": "db", "IP": "192.168.127.3"}
+	]}]}`
+
+	ginkgo.It("should override the records of the base file with the ones of the overlay", func() {
+		zones, err := LoadZoneConfigs(
+			write("base.json", base),
+			write("overlay.json", `{"Zones": [{"Name": "internal", "Records": [{"Name": "web", "IP": "10.0.0.2"}]}]}`),
+		)
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		server := newTestServer(zones, WithoutForwarding())
+		gomega.Expect(resolve(server, "web.internal.")).To(gomega.Equal("10.0.0.2"))
+		gomega.Expect(resolve(server, "db.internal.")).To(gomega.Equal("192.168.127.3"))
+		gomega.Expect(server.Zones()[0].Records).To(gomega.HaveLen(2))
+	})
+
+	ginkgo.It("should load the includes before the zones of the file", func() {
+		write("base.json", base)
+		zones, err := LoadZoneConfigs(write("overlay.json", `{
+			"Include": ["base.json"],
+			"Zones": [{"Name": "internal.", "Records": [{"Name": "web", "IP": "10.0.0.2"}]}]
+		}`))
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		server := newTestServer(zones, WithoutForwarding())
+		gomega.Expect(resolve(server, "web.internal.")).To(gomega.Equal("10.0.0.2"))
+		gomega.Expect(resolve(server, "db.internal.")).To(gomega.Equal("192.168.127.3"))
+	})
+
+	ginkgo.It("should reject the include cycles", func() {
+		write("a.json", `{"Include": ["b.json"]}`)
+		_, err := LoadZoneConfigs(write("b.json", `{"Include": ["a.json"]}`))
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("includes itself")))
+	})
+
+	ginkgo.It("should reject the invalid zones", func() {
+		_, err := LoadZoneConfigs(write("base.json", `{"Zones": [{"Name": "internal."}]}`))
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("neither records nor a default IP")))
+	})
+
+	ginkgo.It("should merge the files again when one of them changes", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		server := newTestServer([]types.Zone{}, WithoutForwarding())
+		basePath := write("base.json", base)
+		overlayPath := write("overlay.json", `{"Zones": []}`)
+		gomega.Expect(server.WatchZoneConfigs(ctx, basePath, overlayPath)).To(gomega.Succeed())
+		gomega.Expect(resolve(server, "web.internal.")).To(gomega.Equal("192.168.127.2"))
+
+		write("overlay.json", `{"Zones": [{"Name": "internal.", "Records": [{"Name": "web", "IP": "10.0.0.2"}]}]}`)
+
+		gomega.Eventually(func() string { return resolve(server, "web.internal.") }).Should(gomega.Equal("10.0.0.2"))
+		gomega.Expect(resolve(server, "db.internal.")).To(gomega.Equal("192.168.127.3"))
+	})
+})
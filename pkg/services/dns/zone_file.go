@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+)
+
+// ParseZoneFile reads a zone file (RFC 1035) for the zone origin. The A and
+// AAAA records of the wildcard name give the default IPs of the zone, the
+// ones of the apex must be the same. The other wildcards become globs. Only
+// the types the zones can serve are supported: A, AAAA, CNAME, TXT, MX and
+// SRV, and SOA and NS at the apex.
+func ParseZoneFile(r io.Reader, origin string) (types.Zone, error) {
+	zone := types.Zone{Name: dns.Fqdn(origin)}
+	// the records of a name are grouped, in the order of the file
+	records := map[string]*types.Record{}
+	var names []string
+	// the extra addresses of a name are answered as separate records
+	var extra []types.Record
+	record := func(name string, ttl uint32) *types.Record {
+		if record, ok := records[name]; ok {
+			return record
+		}
+		record := &types.Record{TTL: ttl}
+		if strings.Contains(name, "*") {
+			record.Glob = name
+		} else {
+			record.Name = name
+		}
+		records[name] = record
+		names = append(names, name)
+		return record
+	}
+	var apexIPs []net.IP
+
+	parser := dns.NewZoneParser(r, zone.Name, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		name, ok := inZone(hdr.Name, zone.Name)
+		if !ok {
+			return types.Zone{}, fmt.Errorf("%s is not in zone %s", hdr.Name, zone.Name)
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			switch {
+			case name == "":
+				apexIPs = append(apexIPs, rr.A)
+			case name == "*":
+				zone.DefaultIP = rr.A
+				zone.DefaultTTL = hdr.Ttl
+			default:
+				if record := record(name, hdr.Ttl); record.IP == nil {
+					record.IP = rr.A
+				} else {
+					extra = append(extra, types.Record{Name: record.Name, Glob: record.Glob, IP: rr.A, TTL: hdr.Ttl})
+				}
+			}
+		case *dns.AAAA:
+			switch name {
+			case "":
+				apexIPs = append(apexIPs, rr.AAAA)
+			case "*":
+				zone.DefaultIPv6 = rr.AAAA
+				zone.DefaultTTL = hdr.Ttl
+			default:
+				if record := record(name, hdr.Ttl); record.IPv6 == nil {
+					record.IPv6 = rr.AAAA
+				} else {
+					extra = append(extra, types.Record{Name: record.Name, Glob: record.Glob, IPv6: rr.AAAA, TTL: hdr.Ttl})
+				}
+			}
+		case *dns.CNAME:
+			record(name, hdr.Ttl).CNAME = rr.Target
+		case *dns.TXT:
+			record := record(name, hdr.Ttl)
+			record.TXT = append(record.TXT, strings.Join(rr.Txt, ""))
+		case *dns.MX:
+			record := record(name, hdr.Ttl)
+			record.MX = append(record.MX, types.MXRecord{Preference: rr.Preference, Exchange: rr.Mx})
+		case *dns.SRV:
+			record := record(name, hdr.Ttl)
+			record.SRV = append(record.SRV, types.SRVRecord{Priority: rr.Priority, Weight: rr.Weight, Port: rr.Port, Target: rr.Target})
+		case *dns.SOA:
+			if name != "" {
+				return types.Zone{}, fmt.Errorf("%s: SOA records are only supported at the apex", hdr.Name)
+			}
+			zone.SOA = &types.SOARecord{
+				Ns:      rr.Ns,
+				Mbox:    rr.Mbox,
+				Serial:  rr.Serial,
+				Refresh: rr.Refresh,
+				Retry:   rr.Retry,
+				Expire:  rr.Expire,
+				Minttl:  rr.Minttl,
+			}
+		case *dns.NS:
+			if name != "" {
+				return types.Zone{}, fmt.Errorf("%s: NS records are only supported at the apex", hdr.Name)
+			}
+			zone.NS = append(zone.NS, rr.Ns)
+		default:
+			return types.Zone{}, fmt.Errorf("%s: %s records are not supported", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return types.Zone{}, err
+	}
+	// the apex is answered with the default IPs
+	for _, ip := range apexIPs {
+		if !ip.Equal(zone.DefaultIP) && !ip.Equal(zone.DefaultIPv6) {
+			return types.Zone{}, fmt.Errorf("the address %s of the apex of zone %s must also be the one of its wildcard", ip, zone.Name)
+		}
+	}
+
+	for _, name := range names {
+		zone.Records = append(zone.Records, *records[name])
+	}
+	zone.Records = append(zone.Records, extra...)
+	return zone, nil
+}
+
+// WriteZoneFile writes zone as a zone file (RFC 1035). The records matched by
+// a regexp or by a glob other than a wildcard, and the views, weights and
+// delegations of the records have no equivalent, they are left out with a
+// comment.
+func WriteZoneFile(w io.Writer, zone types.Zone) error {
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "$ORIGIN %s\n", zone.Name)
+	hdr := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		if name == "" {
+			name = zone.Name
+		} else {
+			name = name + "." + zone.Name
+		}
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	write := func(rr dns.RR) {
+		fmt.Fprintln(buf, rr.String())
+	}
+
+	if soa := zone.SOA; soa != nil {
+		write(&dns.SOA{
+			Hdr:     hdr("", dns.TypeSOA, zone.TTL),
+			Ns:      dns.Fqdn(soa.Ns),
+			Mbox:    dns.Fqdn(soa.Mbox),
+			Serial:  soa.Serial,
+			Refresh: soa.Refresh,
+			Retry:   soa.Retry,
+			Expire:  soa.Expire,
+			Minttl:  soa.Minttl,
+		})
+	}
+	for _, ns := range zone.NS {
+		write(&dns.NS{Hdr: hdr("", dns.TypeNS, zone.TTL), Ns: dns.Fqdn(ns)})
+	}
+	// the default IPs answer both the apex and any other name
+	defaultTTL := zone.DefaultTTL
+	if defaultTTL == 0 {
+		defaultTTL = zone.TTL
+	}
+	for _, name := range []string{"", "*"} {
+		for _, ip := range []net.IP{zone.DefaultIP, zone.DefaultIPv6} {
+			if ip4 := ip.To4(); ip4 != nil {
+				write(&dns.A{Hdr: hdr(name, dns.TypeA, defaultTTL), A: ip4})
+			} else if len(ip) > 0 {
+				write(&dns.AAAA{Hdr: hdr(name, dns.TypeAAAA, defaultTTL), AAAA: ip})
+			}
+		}
+	}
+
+	for _, record := range zone.Records {
+		name := record.Name
+		switch {
+		case record.Regexp != nil:
+			fmt.Fprintf(buf, "; left out the record matching the regexp %s\n", record.Regexp)
+			continue
+		case record.Glob != "":
+			if record.Glob != "*" && (!strings.HasPrefix(record.Glob, "*.") || strings.ContainsAny(record.Glob[2:], "*?[")) {
+				fmt.Fprintf(buf, "; left out the record matching the glob %s\n", record.Glob)
+				continue
+			}
+			name = record.Glob
+		}
+		if len(record.Views) > 0 || record.Weight > 0 || len(record.NS) > 0 {
+			fmt.Fprintf(buf, "; left out the views, weight and delegation of %s\n", name)
+		}
+		ttl := record.TTL
+		if ttl == 0 {
+			ttl = zone.TTL
+		}
+		for _, ip := range []net.IP{record.IP, record.IPv6} {
+			if ip4 := ip.To4(); ip4 != nil {
+				write(&dns.A{Hdr: hdr(name, dns.TypeA, ttl), A: ip4})
+			} else if len(ip) > 0 {
+				write(&dns.AAAA{Hdr: hdr(name, dns.TypeAAAA, ttl), AAAA: ip})
+			}
+		}
+		if record.CNAME != "" {
+			write(&dns.CNAME{Hdr: hdr(name, dns.TypeCNAME, ttl), Target: dns.Fqdn(record.CNAME)})
+		}
+		for _, txt := range record.TXT {
+			write(&dns.TXT{Hdr: hdr(name, dns.TypeTXT, ttl), Txt: splitTXT(txt)})
+		}
+		for _, mx := range record.MX {
+			write(&dns.MX{Hdr: hdr(name, dns.TypeMX, ttl), Preference: mx.Preference, Mx: dns.Fqdn(mx.Exchange)})
+		}
+		for _, srv := range record.SRV {
+			write(&dns.SRV{Hdr: hdr(name, dns.TypeSRV, ttl), Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dns.Fqdn(srv.Target)})
+		}
+	}
+	return buf.Flush()
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+const zoneFile = `$TTL 300
+@       IN SOA  ns1.internal. hostmaster.internal. 2024010101 3600 600 86400 60
+        IN NS   ns1.internal.
+        IN A    192.168.127.254
+*       IN A    192.168.127.254
+ns1     IN A    192.168.127.1
+crc 60  IN A    192.168.127.2
+        IN AAAA fd00::2
+        IN MX   10 mail.internal.
+*.dev   IN A    192.168.127.10
+_ldap._tcp IN SRV 0 5 389 ldap.internal.
+www     IN CNAME crc.internal.
+crc     IN TXT  "v=spf1 -all"
+`
+
+var _ = ginkgo.Describe("dns zone files", func() {
+	ginkgo.It("should parse a zone file into a zone resolving its records", func() {
+		zone, err := ParseZoneFile(strings.NewReader(zoneFile), "internal")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(zone.Name).To(gomega.Equal("internal."))
+		gomega.Expect(zone.DefaultIP.String()).To(gomega.Equal("192.168.127.254"))
+		gomega.Expect(zone.NS).To(gomega.Equal([]string{"ns1.internal."}))
+		gomega.Expect(zone.SOA.Serial).To(gomega.Equal(uint32(2024010101)))
+
+		server, err := New(nil, nil, nil, WithoutForwarding())
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(server.AddZone(zone)).To(gomega.Succeed())
+		ask := func(name string, qtype uint16) *dns.Msg {
+			return server.handler.addAnswers(context.Background(), server.handler.udpClient, nil, query(name, qtype))
+		}
+
+		for name, ip := range map[string]string{
+			"crc.internal.":     "192.168.127.2",
+			"ns1.internal.":     "192.168.127.1",
+			"web.dev.internal.": "192.168.127.10",
+			"other.internal.":   "192.168.127.254",
+			"internal.":         "192.168.127.254",
+		} {
+			m := ask(name, dns.TypeA)
+			gomega.Expect(m.Answer).To(gomega.HaveLen(1), name)
+			gomega.Expect(m.Answer[0].(*dns.A).A.String()).To(gomega.Equal(ip), name)
+		}
+		gomega.Expect(ask("crc.internal.", dns.TypeA).Answer[0].Header().Ttl).To(gomega.Equal(uint32(60)))
+		gomega.Expect(ask("crc.internal.", dns.TypeAAAA).Answer[0].(*dns.AAAA).AAAA.String()).To(gomega.Equal("fd00::2"))
+		gomega.Expect(ask("ns1.internal.", dns.TypeA).Answer[0].Header().Ttl).To(gomega.Equal(uint32(300)))
+		gomega.Expect(ask("crc.internal.", dns.TypeMX).Answer[0].(*dns.MX).Mx).To(gomega.Equal("mail.internal."))
+		gomega.Expect(ask("_ldap._tcp.internal.", dns.TypeSRV).Answer[0].(*dns.SRV).Port).To(gomega.Equal(uint16(389)))
+		gomega.Expect(ask("internal.", dns.TypeSOA).Answer).To(gomega.HaveLen(1))
+		gomega.Expect(ask("www.internal.", dns.TypeA).Answer).To(gomega.HaveLen(2))
+		gomega.Expect(ask("crc.internal.", dns.TypeTXT).Answer[0].(*dns.TXT).Txt).To(gomega.Equal([]string{"v=spf1 -all"}))
+	})
+
+	ginkgo.It("should write a zone file parsed back into the same zone", func() {
+		zone, err := ParseZoneFile(strings.NewReader(zoneFile), "internal.")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+
+		var written strings.Builder
+		gomega.Expect(WriteZoneFile(&written, zone)).To(gomega.Succeed())
+		parsed, err := ParseZoneFile(strings.NewReader(written.String()), "internal.")
+
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(parsed).To(gomega.Equal(zone))
+	})
+
+	ginkgo.It("should leave out the records without equivalent in zone files", func() {
+		var written strings.Builder
+		gomega.Expect(WriteZoneFile(&written, types.Zone{
+			Name: "internal.",
+			Records: []types.Record{
+				{Glob: "web-?", IP: net.ParseIP("192.168.127.2")},
+				{Name: "crc", IP: net.ParseIP("192.168.127.3")},
+			},
+		})).To(gomega.Succeed())
+
+		gomega.Expect(written.String()).To(gomega.Equal("$ORIGIN internal.\n" +
+			"; left out the record matching the glob web-?\n" +
+			"crc.internal.\t0\tIN\tA\t192.168.127.3\n"))
+	})
+
+	for description, content := range map[string]string{
+		"unsupported types":       "info IN HINFO \"amd64\" \"linux\"\n",
+		"names out of the zone":   "crc.example.com. IN A 192.168.127.2\n",
+		"an apex without default": "@ IN A 192.168.127.2\n",
+		"syntax errors":           "crc IN A not-an-ip\n",
+	} {
+		content := content
+		ginkgo.It("should reject zone files with "+description, func() {
+			_, err := ParseZoneFile(strings.NewReader(content), "internal.")
+
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	}
+})
@@ -0,0 +1,272 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+)
+
+// Zones returns a copy of the zones served by the server.
+func (s *Server) Zones() []types.Zone {
+	return copyZones(s.handler.snapshot())
+}
+
+// AddZone adds zone to the server. When a zone with the same name already
+// exists, zone replaces it and the records of both zones are merged.
+func (s *Server) AddZone(zone types.Zone) error {
+	if err := validateZone(zone); err != nil {
+		return err
+	}
+	s.addZone(zone)
+	return nil
+}
+
+// RemoveZone removes the zone called name. It returns false if there is no such zone.
+func (s *Server) RemoveZone(name string) bool {
+	_, removed := s.removeZone(name)
+	return removed
+}
+
+// removeZone is RemoveZone, also returning the number of records of the zone.
+func (s *Server) removeZone(name string) (int, bool) {
+	name = asciiName(dns.Fqdn(name))
+	records, removed := 0, false
+	s.handler.updateZones(func(zones []types.Zone) []types.Zone {
+		for i, zone := range zones {
+			if zone.Name == name {
+				records, removed = len(zone.Records), true
+				return append(zones[:i], zones[i+1:]...)
+			}
+		}
+		return zones
+	})
+	return records, removed
+}
+
+// UpdateZone updates the zone with the same name as zone: its settings are
+// replaced, and so are its records with the same name, regexp or glob as
+// the ones of zone, the other records are kept. zone is added if missing.
+func (s *Server) UpdateZone(zone types.Zone) error {
+	if err := validateZone(zone); err != nil {
+		return err
+	}
+	s.updateZone(zone)
+	return nil
+}
+
+// RemoveRecords removes the records of the zone called name matching the
+// same names as one of records, by name, regexp or glob, whatever their
+// data. It returns the number of records removed, and false if there is no
+// such zone.
+func (s *Server) RemoveRecords(name string, records []types.Record) (int, bool) {
+	req := normalizeZone(types.Zone{Name: name, Records: records})
+	removed, found := 0, false
+	s.handler.updateZones(func(zones []types.Zone) []types.Zone {
+		for i, zone := range zones {
+			if zone.Name != req.Name {
+				continue
+			}
+			found = true
+			kept := make([]types.Record, 0, len(zone.Records))
+			for _, record := range zone.Records {
+				if redefined(req.Records, record) {
+					removed++
+				} else {
+					kept = append(kept, record)
+				}
+			}
+			zones[i].Records = kept
+			return zones
+		}
+		return zones
+	})
+	return removed, found
+}
+
+// SetZones replaces all the zones served by the server.
+func (s *Server) SetZones(zones []types.Zone) error {
+	for _, zone := range zones {
+		if err := validateZone(zone); err != nil {
+			return err
+		}
+	}
+	zones = normalizeZones(zones)
+	s.handler.updateZones(func([]types.Zone) []types.Zone {
+		return zones
+	})
+	return nil
+}
+
+// normalizeZone returns a copy of zone with a fully qualified name, and
+// record names relative to it. Records can be named "web", "web.internal"
+// or "web.internal." in the zone "internal.". The internationalized names
+// and globs are converted to their ASCII form, the regexps are left as is.
+func normalizeZone(zone types.Zone) types.Zone {
+	zone.Name = asciiName(dns.Fqdn(zone.Name))
+	zone.Metadata = copyMetadata(zone.Metadata)
+	if zone.Forwarder != "" {
+		if _, _, err := net.SplitHostPort(zone.Forwarder); err != nil {
+			zone.Forwarder = net.JoinHostPort(strings.Trim(zone.Forwarder, "[]"), "53")
+		}
+	}
+	records := make([]types.Record, len(zone.Records))
+	for i, record := range zone.Records {
+		record.Metadata = copyMetadata(record.Metadata)
+		name := asciiName(strings.TrimSuffix(record.Name, "."))
+		record.Glob = asciiGlob(record.Glob)
+		if withoutZone, ok := inZone(name+".", zone.Name); ok && withoutZone != "" {
+			name = withoutZone
+		}
+		record.Name = name
+		records[i] = record
+	}
+	if zone.Records != nil {
+		zone.Records = records
+	}
+	return zone
+}
+
+func normalizeZones(zones []types.Zone) []types.Zone {
+	normalized := make([]types.Zone, len(zones))
+	for i, zone := range zones {
+		normalized[i] = normalizeZone(zone)
+	}
+	return normalized
+}
+
+func copyZones(zones []types.Zone) []types.Zone {
+	copied := make([]types.Zone, len(zones))
+	for i, zone := range zones {
+		copied[i] = zone
+		copied[i].Metadata = copyMetadata(zone.Metadata)
+		copied[i].Records = append([]types.Record(nil), zone.Records...)
+		for j, record := range zone.Records {
+			copied[i].Records[j].Metadata = copyMetadata(record.Metadata)
+		}
+	}
+	return copied
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// sortedZones returns a copy of zones sorted by name, with their records
+// sorted by name, regexp then glob. The order of zones is left untouched
+// since it matters for matching.
+func sortedZones(zones []types.Zone) []types.Zone {
+	zones = copyZones(zones)
+	sort.SliceStable(zones, func(i, j int) bool {
+		return zones[i].Name < zones[j].Name
+	})
+	for _, zone := range zones {
+		records := zone.Records
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Name != records[j].Name {
+				return records[i].Name < records[j].Name
+			}
+			if regexpString(records[i]) != regexpString(records[j]) {
+				return regexpString(records[i]) < regexpString(records[j])
+			}
+			return records[i].Glob < records[j].Glob
+		})
+	}
+	return zones
+}
+
+func regexpString(record types.Record) string {
+	if record.Regexp == nil {
+		return ""
+	}
+	return record.Regexp.String()
+}
+
+// snapshot returns the zones served by the handler. The returned slice is
+// never modified, the lock is only held to load it.
+func (h *dnsHandler) snapshot() []types.Zone {
+	h.zonesLock.RLock()
+	defer h.zonesLock.RUnlock()
+	return h.zones
+}
+
+// updateZones replaces the zones with the result of update. update is
+// given a copy of the zones it is free to modify. The zone change hook is
+// called once the lock is released, so that it can call the server.
+func (h *dnsHandler) updateZones(update func(zones []types.Zone) []types.Zone) {
+	h.zonesLock.Lock()
+	h.zones = update(append([]types.Zone(nil), h.zones...))
+	h.zonesLock.Unlock()
+	if h.onZoneChange != nil {
+		h.onZoneChange(copyZones(h.snapshot()))
+	}
+}
+
+func (s *Server) addZone(req types.Zone) {
+	s.addZones([]types.Zone{req})
+}
+
+// addZones adds all the zones of reqs at once. The merge with the existing
+// zones happens under the lock, so that concurrent additions to the same
+// zone never lose each other's records.
+func (s *Server) addZones(reqs []types.Zone) {
+	s.handler.updateZones(func(zones []types.Zone) []types.Zone {
+		for _, req := range reqs {
+			zones = mergeZone(zones, normalizeZone(req))
+		}
+		return zones
+	})
+}
+
+// replaceZone replaces the zone with the same name as req, discarding its records.
+func (s *Server) replaceZone(req types.Zone) {
+	req = normalizeZone(req)
+	s.handler.updateZones(func(zones []types.Zone) []types.Zone {
+		for i, zone := range zones {
+			if zone.Name == req.Name {
+				zones[i] = req
+				return zones
+			}
+		}
+		return append(zones, req)
+	})
+}
+
+// updateZone overlays req on the existing zone of the same name, see UpdateZone.
+func (s *Server) updateZone(req types.Zone) {
+	req = normalizeZone(req)
+	s.handler.updateZones(func(zones []types.Zone) []types.Zone {
+		return overlayZone(zones, req)
+	})
+}
+
+// mergeZone adds req to zones, merging its records and metadata with the
+// ones of the zone of the same name.
+func mergeZone(zones []types.Zone, req types.Zone) []types.Zone {
+	for i, zone := range zones {
+		if zone.Name == req.Name {
+			req.Records = append(req.Records[:len(req.Records):len(req.Records)], zone.Records...)
+			// the metadata of the zone is kept, unless req sets the same keys
+			if len(zone.Metadata) > 0 {
+				metadata := copyMetadata(zone.Metadata)
+				for key, value := range req.Metadata {
+					metadata[key] = value
+				}
+				req.Metadata = metadata
+			}
+			zones[i] = req
+			return zones
+		}
+	}
+	// No existing zone for req.Name, add new one
+	return append(zones, req)
+}
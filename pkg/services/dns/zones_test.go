@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("dns zones API", func() {
+	var server *Server
+
+	ginkgo.BeforeEach(func() {
+		server = newTestServer([]types.Zone{}, WithUpstream(unreachableUpstream))
+	})
+
+	ginkgo.It("should add and list zones", func() {
+		zone := types.Zone{Name: "internal.", DefaultIP: net.ParseIP("192.168.127.2")}
+		gomega.Expect(server.AddZone(zone)).To(gomega.Succeed())
+
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{zone}))
+	})
+
+	ginkgo.It("should reject invalid zones", func() {
+		gomega.Expect(server.AddZone(types.Zone{})).To(gomega.MatchError("zone name is empty"))
+		gomega.Expect(server.SetZones([]types.Zone{{Name: "internal."}})).NotTo(gomega.Succeed())
+		gomega.Expect(server.Zones()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should remove zones", func() {
+		gomega.Expect(server.SetZones([]types.Zone{
+			{Name: "a.internal.", DefaultIP: net.ParseIP("192.168.127.2")},
+			{Name: "b.internal.", DefaultIP: net.ParseIP("192.168.127.3")},
+		})).To(gomega.Succeed())
+
+		gomega.Expect(server.RemoveZone("a.internal.")).To(gomega.BeTrue())
+		gomega.Expect(server.RemoveZone("a.internal.")).To(gomega.BeFalse())
+		gomega.Expect(server.Zones()).To(gomega.Equal([]types.Zone{
+			{Name: "b.internal.", DefaultIP: net.ParseIP("192.168.127.3")},
+		}))
+	})
+
+	ginkgo.It("should return zones which cannot modify the server", func() {
+		gomega.Expect(server.AddZone(types.Zone{
+			Name:    "internal.",
+			Records: []types.Record{{Name: "crc", IP: net.ParseIP("192.168.127.2"), Metadata: map[string]string{"owner": "infra"}}},
+		})).To(gomega.Succeed())
+
+		zones := server.Zones()
+		zones[0].Records[0].Name = "modified"
+		zones[0].Records[0].Metadata["owner"] = "modified"
+
+		gomega.Expect(server.Zones()[0].Records[0].Name).To(gomega.Equal("crc"))
+		gomega.Expect(server.Zones()[0].Records[0].Metadata["owner"]).To(gomega.Equal("infra"))
+	})
+
+	ginkgo.It("should be safe for concurrent use", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer ginkgo.GinkgoRecover()
+				defer wg.Done()
+				name := fmt.Sprintf("zone%d.internal.", i)
+				gomega.Expect(server.AddZone(types.Zone{Name: name, DefaultIP: net.ParseIP("192.168.127.2")})).To(gomega.Succeed())
+				_ = server.Zones()
+				if i%2 == 0 {
+					gomega.Expect(server.RemoveZone(name)).To(gomega.BeTrue())
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		gomega.Expect(server.Zones()).To(gomega.HaveLen(10))
+	})
+})
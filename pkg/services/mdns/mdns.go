@@ -0,0 +1,178 @@
+package mdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Port is the port of the mDNS queries and responses.
+	Port = 5353
+	// ttl of the answers, the one recommended for the address records
+	ttl = 120
+	// legacyTTL is the TTL of the answers to the one-shot queries of plain
+	// resolvers, which don't expect the records to be refreshed
+	legacyTTL = 10
+	// cacheFlush is the top bit of the class of the records answered, telling
+	// the clients that they replace the cached ones (RFC 6762 section 10.2)
+	cacheFlush = 1 << 15
+	// unicastResponse is the top bit of the class of the questions whose
+	// answer is preferred over unicast (RFC 6762 section 5.4)
+	unicastResponse = 1 << 15
+	// maxMessageSize is the largest mDNS message over Ethernet
+	maxMessageSize = 9000
+)
+
+// Group is the IPv4 multicast address of mDNS.
+var Group = net.IPv4(224, 0, 0, 251)
+
+// LookupFunc returns the addresses of name, the label of a .local name such
+// as "gateway" for "gateway.local.", or nil if the name is unknown.
+type LookupFunc func(name string) []net.IP
+
+// Responder answers the mDNS queries (RFC 6762) for the addresses of .local
+// names. It doesn't probe nor announce the names, they are only answered.
+type Responder struct {
+	conn   net.PacketConn
+	lookup LookupFunc
+}
+
+// New returns a responder answering the queries received on conn, which
+// must be bound to Port and receive the packets sent to Group.
+func New(conn net.PacketConn, lookup LookupFunc) *Responder {
+	return &Responder{conn: conn, lookup: lookup}
+}
+
+// Serve answers the queries until the connection is closed.
+func (r *Responder) Serve() error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, src, err := r.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil {
+			log.Debugf("mdns: cannot parse message from %v: %v", src, err)
+			continue
+		}
+		udpSrc, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resp, dst := r.respond(req, udpSrc)
+		if resp == nil {
+			continue
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			log.Errorf("mdns: cannot pack response: %v", err)
+			continue
+		}
+		if _, err := r.conn.WriteTo(out, dst); err != nil {
+			log.Errorf("mdns: cannot send response to %v: %v", dst, err)
+		}
+	}
+}
+
+// respond returns the response to req, sent from src, and where to send it,
+// or nil if there is nothing to answer.
+func (r *Responder) respond(req *dns.Msg, src *net.UDPAddr) (*dns.Msg, net.Addr) {
+	// the responses of the other responders and the queries with a rcode are ignored
+	if req.Response || req.Opcode != dns.OpcodeQuery || req.Rcode != dns.RcodeSuccess {
+		return nil, nil
+	}
+	// a query from another port comes from a plain resolver expecting a
+	// regular DNS response (RFC 6762 section 6.7)
+	legacy := src.Port != Port
+	unicast := legacy
+	resp := new(dns.Msg)
+	for _, q := range req.Question {
+		answers := r.answer(q)
+		if len(answers) == 0 {
+			continue
+		}
+		if q.Qclass&unicastResponse != 0 {
+			unicast = true
+		}
+		for _, rr := range answers {
+			if knownAnswer(req, rr) {
+				continue
+			}
+			if legacy {
+				rr.Header().Ttl = legacyTTL
+			} else {
+				rr.Header().Class |= cacheFlush
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil, nil
+	}
+	resp.Response = true
+	resp.Authoritative = true
+	if legacy {
+		resp.Id = req.Id
+		resp.Question = req.Question
+		return resp, src
+	}
+	if unicast {
+		return resp, src
+	}
+	return resp, &net.UDPAddr{IP: Group, Port: Port}
+}
+
+// answer returns the address records of the name of q, in the class IN.
+func (r *Responder) answer(q dns.Question) []dns.RR {
+	if q.Qclass&^unicastResponse != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA && q.Qtype != dns.TypeANY) {
+		return nil
+	}
+	name, ok := localName(q.Name)
+	if !ok {
+		return nil
+	}
+	var answers []dns.RR
+	for _, ip := range r.lookup(name) {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Qtype != dns.TypeAAAA {
+				hdr.Rrtype = dns.TypeA
+				answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+			}
+		} else if q.Qtype != dns.TypeA {
+			hdr.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answers
+}
+
+// localName returns the label of name, a single label .local name.
+func localName(name string) (string, bool) {
+	label, ok := strings.CutSuffix(strings.ToLower(dns.Fqdn(name)), ".local.")
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// knownAnswer returns true if req lists rr among the answers it already
+// knows, with at least half of its TTL left (RFC 6762 section 7.1).
+func knownAnswer(req *dns.Msg, rr dns.RR) bool {
+	for _, known := range req.Answer {
+		known = dns.Copy(known)
+		known.Header().Class &^= cacheFlush
+		if known.Header().Ttl >= rr.Header().Ttl/2 && dns.IsDuplicate(known, rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "gvisor-tap-vsock mdns suit")
+}
+
+var _ = ginkgo.Describe("mdns", func() {
+	responder := New(nil, func(name string) []net.IP {
+		if name == "gateway" {
+			return []net.IP{net.ParseIP("192.168.127.1"), net.ParseIP("fd00::1")}
+		}
+		return nil
+	})
+	peer := &net.UDPAddr{IP: net.ParseIP("192.168.127.2"), Port: Port}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Id = 0
+		m.RecursionDesired = false
+		return m
+	}
+
+	ginkgo.It("should multicast the addresses of the names", func() {
+		resp, dst := responder.respond(query("Gateway.local.", dns.TypeA), peer)
+
+		gomega.Expect(dst).To(gomega.Equal(&net.UDPAddr{IP: Group, Port: Port}))
+		gomega.Expect(resp.Response).To(gomega.BeTrue())
+		gomega.Expect(resp.Authoritative).To(gomega.BeTrue())
+		gomega.Expect(resp.Question).To(gomega.BeEmpty())
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(resp.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.1"))
+		gomega.Expect(resp.Answer[0].Header().Class).To(gomega.Equal(uint16(dns.ClassINET | cacheFlush)))
+		gomega.Expect(resp.Answer[0].Header().Ttl).To(gomega.Equal(uint32(ttl)))
+
+		resp, _ = responder.respond(query("gateway.local.", dns.TypeANY), peer)
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(2))
+		gomega.Expect(resp.Answer[1].(*dns.AAAA).AAAA.String()).To(gomega.Equal("fd00::1"))
+	})
+
+	ginkgo.It("should stay silent for the names it doesn't know", func() {
+		for _, name := range []string{"unknown.local.", "gateway.example.com.", "sub.gateway.local.", "local."} {
+			resp, _ := responder.respond(query(name, dns.TypeA), peer)
+			gomega.Expect(resp).To(gomega.BeNil(), name)
+		}
+		resp, _ := responder.respond(query("gateway.local.", dns.TypeMX), peer)
+		gomega.Expect(resp).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should ignore the responses of the other responders", func() {
+		m := query("gateway.local.", dns.TypeA)
+		m.Response = true
+
+		resp, _ := responder.respond(m, peer)
+		gomega.Expect(resp).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should answer over unicast when asked to", func() {
+		m := query("gateway.local.", dns.TypeA)
+		m.Question[0].Qclass |= unicastResponse
+
+		resp, dst := responder.respond(m, peer)
+
+		gomega.Expect(dst).To(gomega.Equal(peer))
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should answer the queries of plain resolvers like a DNS server", func() {
+		m := query("gateway.local.", dns.TypeA)
+		m.Id = 1234
+		legacy := &net.UDPAddr{IP: net.ParseIP("192.168.127.2"), Port: 40000}
+
+		resp, dst := responder.respond(m, legacy)
+
+		gomega.Expect(dst).To(gomega.Equal(legacy))
+		gomega.Expect(resp.Id).To(gomega.Equal(uint16(1234)))
+		gomega.Expect(resp.Question).To(gomega.Equal(m.Question))
+		gomega.Expect(resp.Answer[0].Header().Class).To(gomega.Equal(uint16(dns.ClassINET)))
+		gomega.Expect(resp.Answer[0].Header().Ttl).To(gomega.Equal(uint32(legacyTTL)))
+	})
+
+	ginkgo.It("should leave out the answers the querier already knows", func() {
+		m := query("gateway.local.", dns.TypeA)
+		known := &dns.A{
+			Hdr: dns.RR_Header{Name: "gateway.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP("192.168.127.1").To4(),
+		}
+		m.Answer = []dns.RR{known}
+
+		resp, _ := responder.respond(m, peer)
+		gomega.Expect(resp).To(gomega.BeNil())
+
+		known.Hdr.Ttl = ttl/2 - 1
+		resp, _ = responder.respond(m, peer)
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should serve the queries received on its connection", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		served := make(chan error, 1)
+		go func() {
+			served <- New(conn, responder.lookup).Serve()
+		}()
+
+		client := &dns.Client{Net: "udp", Timeout: time.Second}
+		resp, _, err := client.Exchange(query("gateway.local.", dns.TypeA), conn.LocalAddr().String())
+
+		gomega.Expect(err).ShouldNot(gomega.HaveOccurred())
+		gomega.Expect(resp.Answer).To(gomega.HaveLen(1))
+		gomega.Expect(resp.Answer[0].(*dns.A).A.String()).To(gomega.Equal("192.168.127.1"))
+
+		gomega.Expect(conn.Close()).To(gomega.Succeed())
+		gomega.Eventually(served).Should(gomega.Receive(gomega.BeNil()))
+	})
+})
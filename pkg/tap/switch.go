@@ -126,7 +126,8 @@ func (e *Switch) txPkt(pkt stack.PacketBufferPtr) error {
 	dst := eth.DestinationAddress()
 	src := eth.SourceAddress()
 
-	if dst == header.EthernetBroadcastAddress {
+	// the broadcast and multicast frames, such as the mDNS ones, go to all the VMs
+	if header.IsMulticastEthernetAddress(dst) {
 		e.camLock.RLock()
 		srcID, ok := e.cam[src]
 		if !ok {
@@ -269,7 +270,8 @@ func (e *Switch) rxBuf(_ context.Context, id int, buf []byte) {
 		}
 		pkt.DecRef()
 	}
-	if eth.DestinationAddress() == e.gateway.LinkAddress() || eth.DestinationAddress() == header.EthernetBroadcastAddress {
+	// the stack drops the multicast packets of the groups it didn't join
+	if eth.DestinationAddress() == e.gateway.LinkAddress() || header.IsMulticastEthernetAddress(eth.DestinationAddress()) {
 		data := buffer.MakeWithData(buf)
 		data.TrimFront(header.EthernetMinimumSize)
 		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
@@ -31,6 +31,41 @@ type Configuration struct {
 	// List of search domains that will be added in all DHCP replies
 	DNSSearchDomains []string
 
+	// Upstream nameserver of the DNS server, such as "1.1.1.1", "tls://1.1.1.1#cloudflare-dns.com" for DNS over TLS
+	// or "https://cloudflare-dns.com/dns-query" for DNS over HTTPS. Empty uses the one configured on the host
+	DNSUpstream string
+
+	// TTL of the answers of the DNS server from the zones and the hosts file, unless the zone or the record has
+	// one. 0 lets the guests cache no answer
+	DNSDefaultTTL uint32
+
+	// Hosts files such as /etc/hosts, or directories of hosts files such as ~/.config/containers/hosts.d, whose names
+	// are resolved by the DNS server, reloaded when they change. The names of a file override the ones of the files
+	// before it. Empty resolves no name from a hosts file
+	DNSHostsFiles []string
+
+	// Files of names blocked by the DNS server, with their subdomains, in the hosts format or one name per line.
+	// They are answered as nonexistent, or with the null addresses when DNSBlockNullAddress is set
+	DNSBlocklists []string
+
+	// Files of names, with their subdomains, which are not blocked by DNSBlocklists, in the same formats
+	DNSAllowlists []string
+
+	// Answer the names of DNSBlocklists with 0.0.0.0 and :: rather than as nonexistent
+	DNSBlockNullAddress bool
+
+	// Queries per second answered to each client of the DNS server, the excess is truncated over UDP and refused
+	// over TCP. Zero doesn't limit the rate
+	DNSRateLimit float64
+
+	// Queries answered at once to a client of the DNS server before DNSRateLimit applies. Zero allows a second of
+	// queries
+	DNSRateLimitBurst int
+
+	// Answer the mDNS queries for the .local names of the records of the DNS zones, such as gateway.local,
+	// inside the virtual network
+	MDNS bool
+
 	// Port forwarding between the machine running the gateway and the virtual network.
 	Forwards map[string]string
 
@@ -71,10 +106,101 @@ type Zone struct {
 	Name      string
 	Records   []Record
 	DefaultIP net.IP
+	// IPv6 address answered over AAAA to the names of the zone without a record, when DefaultIP is an IPv4 address
+	DefaultIPv6 net.IP
+	// TTL of the answers with the default IPs only, as they may be more volatile than the records. 0 uses TTL
+	DefaultTTL uint32
+	// TTL of the answers from the zone, unless the record has one. 0 uses the default TTL of the server
+	TTL uint32
+	// Start of authority answered to SOA queries at the apex of the zone
+	SOA *SOARecord
+	// Hosts of the nameservers answered to NS queries at the apex of the zone
+	NS []string
+	// Address, as "ip[:port]", of the nameserver the names of the zone without a record are forwarded to
+	// instead of the upstream nameserver of the server. Empty answers them from the zone
+	Forwarder string `json:",omitempty"`
+	// Free-form annotations, such as an owner or a source, kept for auditing and never used to answer queries
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// SOARecord is the start of authority of a zone (RFC 1035)
+type SOARecord struct {
+	// Primary nameserver of the zone
+	Ns string
+	// Mailbox of the administrator of the zone, such as hostmaster.example.com.
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// TTL of the negative answers
+	Minttl uint32
 }
 
 type Record struct {
-	Name   string
-	IP     net.IP
+	// The records with the exact Name of a query take precedence over the ones matching it with Regexp or Glob
+	Name string
+	IP   net.IP
+	// IPv6 address answered over AAAA along with an IPv4 address in IP. An IPv6 address in IP is answered over AAAA too
+	IPv6   net.IP
 	Regexp *regexp.Regexp
+	MX     []MXRecord
+	SRV    []SRVRecord
+	// Canonical name the record is an alias of, answered to the queries of any type. It excludes any other data
+	CNAME string
+	// Texts answered to TXT queries, one record each
+	TXT []string
+	// Shell pattern matching names, such as "*-dev" or "web-?", a simpler alternative to Regexp
+	Glob string
+	// Split-horizon: clients in the subnet of one of the views get its IP instead of the default one
+	Views []View
+	// When several records with a weight match a name, one of them is answered with a probability proportional to its weight
+	Weight uint16
+	// Delegates the subdomain named after the record to other nameservers
+	NS []NSRecord
+	// TTL of the answers from the record. 0 uses the TTL of the zone
+	TTL uint32
+	// Service bindings answered to SVCB and HTTPS queries
+	SVCB  []SVCBRecord
+	HTTPS []SVCBRecord
+	// Free-form annotations, such as an owner or a source, kept for auditing and never used to answer queries
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// SVCBRecord is a service binding served for the name of the record (RFC 9460).
+// Priority 0 makes it an alias to Target, an empty Target stands for the name itself
+type SVCBRecord struct {
+	Priority uint16
+	Target   string
+	// Optional parameters, left out when empty
+	ALPN     []string
+	Port     uint16
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+}
+
+// NSRecord is a nameserver of a delegated subdomain. IP is the optional glue address of Host.
+type NSRecord struct {
+	Host string
+	IP   net.IP
+}
+
+// View is the IP served for a record to the clients in Subnet (CIDR notation)
+type View struct {
+	Subnet string
+	IP     net.IP
+}
+
+// MXRecord is a mail exchanger served for the name of the record (RFC 1035)
+type MXRecord struct {
+	Preference uint16
+	Exchange   string
+}
+
+// SRVRecord is a service location served for the name of the record (RFC 2782)
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
 }
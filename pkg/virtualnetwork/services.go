@@ -1,6 +1,8 @@
 package virtualnetwork
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
@@ -9,6 +11,7 @@ import (
 	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
 	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
 	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/mdns"
 	"github.com/containers/gvisor-tap-vsock/pkg/tap"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	log "github.com/sirupsen/logrus"
@@ -29,11 +32,17 @@ func addServices(configuration *types.Configuration, s *stack.Stack, ipPool *tap
 	udpForwarder := forwarder.UDP(s, translation, &natLock)
 	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
 
-	dnsMux, err := dnsServer(configuration, s)
+	dnsSrv, dnsMux, err := dnsServer(configuration, s)
 	if err != nil {
 		return nil, err
 	}
 
+	if configuration.MDNS {
+		if err := mdnsResponder(s, dnsSrv); err != nil {
+			return nil, err
+		}
+	}
+
 	dhcpMux, err := dhcpServer(configuration, s, ipPool)
 	if err != nil {
 		return nil, err
@@ -58,14 +67,14 @@ func parseNATTable(configuration *types.Configuration) map[tcpip.Address]tcpip.A
 	return translation
 }
 
-func dnsServer(configuration *types.Configuration, s *stack.Stack) (http.Handler, error) {
+func dnsServer(configuration *types.Configuration, s *stack.Stack) (*dns.Server, http.Handler, error) {
 	udpConn, err := gonet.DialUDP(s, &tcpip.FullAddress{
 		NIC:  1,
 		Addr: tcpip.AddrFrom4Slice(net.ParseIP(configuration.GatewayIP).To4()),
 		Port: uint16(53),
 	}, nil, ipv4.ProtocolNumber)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	tcpLn, err := gonet.ListenTCP(s, tcpip.FullAddress{
@@ -74,12 +83,50 @@ func dnsServer(configuration *types.Configuration, s *stack.Stack) (http.Handler
 		Port: uint16(53),
 	}, ipv4.ProtocolNumber)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	server, err := dns.New(udpConn, tcpLn, configuration.DNS)
+	var opts []dns.Option
+	if configuration.DNSUpstream != "" {
+		upstream, err := dns.ParseUpstream(configuration.DNSUpstream)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, upstream)
+	}
+	if configuration.DNSDefaultTTL != 0 {
+		opts = append(opts, dns.WithDefaultTTL(configuration.DNSDefaultTTL))
+	}
+	if len(configuration.DNSHostsFiles) > 0 {
+		hostsFile, err := dns.NewHostsFile(configuration.DNSHostsFiles...)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, dns.WithHostsFile(hostsFile))
+	}
+	if len(configuration.DNSBlocklists) > 0 {
+		mode := dns.BlockNXDomain
+		if configuration.DNSBlockNullAddress {
+			mode = dns.BlockNullAddress
+		}
+		blocklist, err := dns.NewBlocklist(configuration.DNSBlocklists, configuration.DNSAllowlists, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, dns.WithBlocklist(blocklist))
+	}
+	if configuration.DNSRateLimit > 0 {
+		opts = append(opts, dns.WithRateLimit(configuration.DNSRateLimit, configuration.DNSRateLimitBurst))
+	}
+	server, err := dns.New(udpConn, tcpLn, configuration.DNS, opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if configuration.DNSUpstream == "" {
+		// follow the nameservers of the host as it moves between networks
+		if err := server.WatchUpstream(context.Background()); err != nil {
+			log.Warnf("cannot watch the nameservers of the host: %v", err)
+		}
 	}
 
 	go func() {
@@ -92,7 +139,54 @@ func dnsServer(configuration *types.Configuration, s *stack.Stack) (http.Handler
 			log.Error(err)
 		}
 	}()
-	return server.Mux(), nil
+	return server, server.Mux(), nil
+}
+
+// mdnsResponder answers the mDNS queries of the virtual network for the
+// .local names of the records of the zones of dnsSrv, such as
+// gateway.local for the record gateway of the zone containers.internal.
+func mdnsResponder(s *stack.Stack, dnsSrv *dns.Server) error {
+	if err := s.JoinGroup(ipv4.ProtocolNumber, 1, tcpip.AddrFrom4Slice(mdns.Group.To4())); err != nil {
+		return errors.New(err.String())
+	}
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{
+		NIC:  1,
+		Port: mdns.Port,
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	responder := mdns.New(conn, func(name string) []net.IP {
+		var ips []net.IP
+		for _, zone := range dnsSrv.Zones() {
+			for _, record := range zone.Records {
+				if !strings.EqualFold(record.Name, name) {
+					continue
+				}
+				for _, ip := range []net.IP{record.IP, record.IPv6} {
+					if ip != nil && !containsIP(ips, ip) {
+						ips = append(ips, ip)
+					}
+				}
+			}
+		}
+		return ips
+	})
+	go func() {
+		if err := responder.Serve(); err != nil {
+			log.Error(err)
+		}
+	}()
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func dhcpServer(configuration *types.Configuration, s *stack.Stack, ipPool *tap.IPPool) (http.Handler, error) {